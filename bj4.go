@@ -27,16 +27,26 @@
  * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
  */
 
-// Package bj4 provides one-task-at-a-time task scheduling.
+// Package bj4 provides in-process task scheduling.  Tasks run on their own
+// goroutines, one at a time by default, or as many at a time as Concurrency in
+// Config allows.
 package bj4
 
 import (
+	"container/heap"
+	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	minWaitTime = 1 * time.Hour
+	minWaitTime         = 1 * time.Hour
+	defaultHistoryLimit = 10
 )
 
 // Config configures the scheduler
@@ -50,30 +60,137 @@ type Config struct {
 	// TaskTTL is the timeout when a task is not scheduled anymore.  If not
 	// set, all tasks will be kept.
 	TaskTTL time.Duration
+	// TaskTimeout is the default timeout of every task run.  It can be
+	// overridden per task with WithTimeout.  If not set, runs never time
+	// out.
+	TaskTimeout time.Duration
+	// PanicPolicy decides what to do when a task function panics.  The
+	// default is PanicRecover.
+	PanicPolicy PanicPolicy
+	// Concurrency is the maximum number of tasks running at the same time.
+	// Tasks of the same name never run at the same time.  The default is 1,
+	// which runs one task at a time.
+	Concurrency int
+	// AgingThreshold promotes a due task by one priority for every
+	// AgingThreshold it has been overdue, counting fractions of an
+	// AgingThreshold, so that tasks of low priority are not starved by those
+	// of high priority.  If not set, tasks are never promoted.
+	AgingThreshold time.Duration
+	// Store persists the status of tasks, so that tasks added with Register
+	// are restored when the scheduler starts.  If not set, nothing is
+	// persisted.
+	Store Store
+	// Elector elects a leader among the replicas of the scheduler, and
+	// only the leader runs tasks.  If not set, the scheduler always runs
+	// tasks.
+	Elector LeaderElector
+	// ElectorID identifies the scheduler to the Elector and the Locker.
+	// The default is made of the host name, the process ID and a random
+	// string.
+	ElectorID string
+	// LeaseTTL is how long the leadership lasts unless renewed.  The
+	// leadership is renewed every third of LeaseTTL.  The default is 15
+	// seconds.
+	LeaseTTL time.Duration
+	// Locker locks every run of a task, so that replicas of the scheduler
+	// with the same tasks share the load, and each run is done by only one
+	// of them.  A run whose lock is held elsewhere is skipped.  If not set,
+	// runs are not locked.
+	Locker LockProvider
+	// LockTTL is how long the lock of a run lasts unless renewed.  The lock
+	// is renewed every third of LockTTL until the task function returns,
+	// even after the run times out.  The default is 1 minute.
+	LockTTL time.Duration
+	// HistoryLimit is the number of run records kept in memory for every
+	// task, which are returned by GetHistory.  The default is 10.
+	HistoryLimit int
+	// Middlewares wrap the function of every task, e.g. for tracing.  The
+	// first one is the outermost.
+	Middlewares []TaskMiddleware
+	// Clock is the source of time of the scheduler.  The default is
+	// RealClock.  Use a FakeClock in tests.
+	Clock Clock
 }
 
+// PanicPolicy decides what to do when a task function panics.  In every case
+// the panic is converted into a *PanicError, which is reported to
+// Logger.OnTaskError and the error channel of the task.
+type PanicPolicy int
+
+const (
+	// PanicRecover recovers the panic and keeps the task scheduled.
+	PanicRecover PanicPolicy = iota
+	// PanicRecoverAndDisable disables the task.
+	PanicRecoverAndDisable
+	// PanicRepanic panics again with the *PanicError on the goroutine
+	// running Start.
+	PanicRepanic
+)
+
 // BJ4 is the scheduler struct itself. Refer to its member functions for
 // details.
 type BJ4 struct {
-	state          string
+	seq            uint64 // accessed atomically; keep 64-bit aligned
 	tasks          map[string]*Task
-	taskAdded      chan *Task
+	queue          taskQueue
+	ready          readyQueue
+	pending        map[string]*Task
+	opChan         chan func()
 	logger         Logger
 	minWaitTime    time.Duration
 	taskTTL        time.Duration
-	stopChan       chan struct{}
-	removeTaskChan chan string
+	taskTimeout    time.Duration
+	panicPolicy    PanicPolicy
+	concurrency    int
+	agingThreshold time.Duration
+	store          Store
+	stored         map[string]TaskStatus
+	restored       map[string]bool
+	elector        LeaderElector
+	electorID      string
+	leaseTTL       time.Duration
+	leader         bool
+	token          uint64
+	leaseExpiry    time.Time
+	nextCampaign   time.Time
+	locker         LockProvider
+	lockTTL        time.Duration
+	historyLimit   int
+	middlewares    []TaskMiddleware
+	clock          Clock
+	idleWaiters    []chan struct{}
+	paused         bool
+	taskDone       chan taskResult
+
+	// mu guards the fields below.  quit is closed once the scheduler is
+	// stopping, abandon is closed by Shutdown for abandoning the running
+	// tasks, and done is closed once the goroutine running Start stops
+	// touching the tasks.  abandoned is the names of the abandoned tasks.
+	// backlog is the operations queued while the scheduler is not started.
+	mu        sync.Mutex
+	state     string
+	quit      chan struct{}
+	abandon   chan struct{}
+	done      chan struct{}
+	abandoned []string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	running   map[string]context.CancelFunc
+	backlog   []func()
 }
 
 const (
 	stateStopped  = "stopped"
+	stateStarting = "starting"
 	stateStarted  = "started"
 	stateStopping = "stopping"
 )
 
 var (
-	ErrNotStopped = errors.New("bj4 has not stopped")
-	ErrNotStarted = errors.New("bj4 has not started")
+	ErrNotStopped    = errors.New("bj4 has not stopped")
+	ErrNotStarted    = errors.New("bj4 has not started")
+	ErrTaskTimeout   = errors.New("bj4 task timed out")
+	ErrTaskAbandoned = errors.New("bj4 task abandoned on shutdown")
 )
 
 // New initiates the scheduler
@@ -84,89 +201,430 @@ func New(config *Config) *BJ4 {
 	if config.MinWaitTime == 0 {
 		config.MinWaitTime = minWaitTime
 	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.ElectorID == "" {
+		config.ElectorID = defaultElectorID()
+	}
+	if config.LeaseTTL == 0 {
+		config.LeaseTTL = defaultLeaseTTL
+	}
+	if config.LockTTL == 0 {
+		config.LockTTL = defaultLockTTL
+	}
+	if config.Clock == nil {
+		config.Clock = RealClock{}
+	}
+	if config.HistoryLimit <= 0 {
+		config.HistoryLimit = defaultHistoryLimit
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &BJ4{
 		state:          stateStopped,
 		tasks:          make(map[string]*Task),
-		taskAdded:      make(chan *Task, 16),
+		pending:        make(map[string]*Task),
+		opChan:         make(chan func(), 16),
 		logger:         config.Logger,
 		minWaitTime:    config.MinWaitTime,
 		taskTTL:        config.TaskTTL,
-		stopChan:       make(chan struct{}), // stopChan must be unbuffered channel, or (*BJ4).Stop() won't wait until bj4 runner stopped
-		removeTaskChan: make(chan string, 16),
+		taskTimeout:    config.TaskTimeout,
+		panicPolicy:    config.PanicPolicy,
+		concurrency:    config.Concurrency,
+		agingThreshold: config.AgingThreshold,
+		store:          config.Store,
+		elector:        config.Elector,
+		electorID:      config.ElectorID,
+		leaseTTL:       config.LeaseTTL,
+		locker:         config.Locker,
+		lockTTL:        config.LockTTL,
+		historyLimit:   config.HistoryLimit,
+		middlewares:    config.Middlewares,
+		clock:          config.Clock,
+		quit:           make(chan struct{}),
+		taskDone:       make(chan taskResult, config.Concurrency),
+		ctx:            ctx,
+		cancel:         cancel,
+		running:        make(map[string]context.CancelFunc),
 	}
 }
 
-// Start runs the scheduler.  Returns error if the scheduler has been started.
+// Start runs the scheduler until Stop or Shutdown is called.  If there is a
+// Store, the stored statuses are loaded for restoring the tasks added with
+// Register.  Returns error if the scheduler has been started, or if the
+// statuses cannot be loaded.
 func (bj4 *BJ4) Start() error {
+	return bj4.Run(context.Background())
+}
+
+// Run runs the scheduler like Start, and stops it like Stop once ctx is
+// cancelled.  Returns the error of ctx if it stops because ctx is cancelled.
+func (bj4 *BJ4) Run(ctx context.Context) error {
+	if err := bj4.begin(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		bj4.Stop()
+	})
+	defer stop()
+
+	bj4.logger.OnStart()
+	bj4.loop()
+	return ctx.Err()
+}
+
+// begin moves the scheduler to the started state, loading the Store.
+func (bj4 *BJ4) begin() error {
+	bj4.mu.Lock()
 	if bj4.state != stateStopped {
+		bj4.mu.Unlock()
 		return ErrNotStopped
 	}
+	bj4.state = stateStarting
+	bj4.mu.Unlock()
+
+	err := bj4.loadStore()
+	bj4.mu.Lock()
+	defer bj4.mu.Unlock()
+	if err != nil {
+		bj4.state = stateStopped
+		return err
+	}
+	// the operations left by the last run come before the ones queued since
+	var ops []func()
+	for len(bj4.opChan) > 0 {
+		ops = append(ops, <-bj4.opChan)
+	}
+	bj4.backlog = append(ops, bj4.backlog...)
 	bj4.state = stateStarted
-	bj4.logger.OnStart()
-	for {
+	bj4.quit = make(chan struct{})
+	bj4.abandon = make(chan struct{})
+	bj4.done = make(chan struct{})
+	bj4.abandoned = nil
+	bj4.paused = false
+	bj4.ctx, bj4.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+// loop runs the due tasks until the scheduler is stopping, and then waits for
+// the running tasks to be done, or abandons them.
+func (bj4 *BJ4) loop() {
+	for stopped := false; !stopped; {
+		bj4.campaign()
 		bj4.run()
-		stop := bj4.wait()
-		if stop {
-			break
+		stopped = bj4.wait()
+	}
+
+	// wait for the running tasks to be done
+	var abandoned []string
+	for abandoned == nil && bj4.runningCount() > 0 {
+		select {
+		case res := <-bj4.taskDone:
+			bj4.finishTask(res)
+		case <-bj4.abandon:
+			abandoned = bj4.abandonTasks()
 		}
 	}
+	bj4.resign()
+	bj4.mu.Lock()
 	bj4.state = stateStopped
-	return nil
+	bj4.abandoned = abandoned
+	close(bj4.done)
+	bj4.mu.Unlock()
 }
 
-// Stop stops the scheduler.  Returns error if the scheduler has not been
-// started.
+// Stop stops the scheduler.  The contexts of the running tasks are cancelled,
+// and Stop waits until they return, however long it takes; use Shutdown to
+// stop with a deadline.  Returns error if the scheduler has not been started.
 func (bj4 *BJ4) Stop() error {
+	done, _, err := bj4.stop(true)
+	if err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// Shutdown stops the scheduler gracefully.  No more task is started, and
+// Shutdown waits for the running tasks to be done until ctx is done.  Then the
+// contexts of the tasks still running are cancelled, and they are abandoned
+// without waiting for them to return.  The abandoned runs are not counted as
+// done: the tasks are due again as soon as the scheduler restarts.  Returns a
+// *ShutdownError listing the abandoned tasks if there are any, or error if the
+// scheduler has not been started.
+func (bj4 *BJ4) Shutdown(ctx context.Context) error {
+	done, abandon, err := bj4.stop(false)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	bj4.mu.Lock()
+	bj4.cancel()
+	bj4.mu.Unlock()
+	close(abandon)
+	<-done
+
+	bj4.mu.Lock()
+	defer bj4.mu.Unlock()
+	if len(bj4.abandoned) == 0 {
+		return nil
+	}
+	return &ShutdownError{Tasks: bj4.abandoned, Err: ctx.Err()}
+}
+
+// stop moves the scheduler to the stopping state, optionally cancelling the
+// running tasks.  Returns the channel closed once the scheduler has stopped,
+// and the channel to close for abandoning the running tasks.
+func (bj4 *BJ4) stop(cancel bool) (done, abandon chan struct{}, err error) {
+	bj4.mu.Lock()
+	defer bj4.mu.Unlock()
 	if bj4.state != stateStarted {
-		return ErrNotStarted
+		return nil, nil, ErrNotStarted
 	}
-	// block until wait() receives the stop signal
-	bj4.stopChan <- struct{}{}
+	bj4.state = stateStopping
+	close(bj4.quit)
+	if cancel {
+		bj4.cancel()
+	}
+	return bj4.done, bj4.abandon, nil
+}
 
-	return nil
+// ShutdownError is returned by Shutdown if it abandons running tasks.
+type ShutdownError struct {
+	// Tasks is the names of the abandoned tasks, sorted.
+	Tasks []string
+	// Err is the error of the context passed to Shutdown.
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("bj4 shutdown abandoned %d running task(s): %s: %v",
+		len(e.Tasks), strings.Join(e.Tasks, ", "), e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
 }
 
+// run starts the due tasks as long as the concurrency allows.  Due tasks are
+// started in the order of their priorities, including the promotion from
+// aging, and then the order in the queue.
 func (bj4 *BJ4) run() {
-	for _, task := range bj4.tasks {
-		task.run()
+	// do not start any more task once Stop is called
+	select {
+	case <-bj4.quit:
+		return
+	default:
+	}
+	if bj4.elector != nil && !bj4.leader || bj4.paused {
+		return
+	}
+	slots := bj4.concurrency - bj4.runningCount()
+	if slots <= 0 {
+		return
+	}
+
+	now := bj4.clock.Now()
+	for {
+		task := bj4.queue.peek()
+		if task == nil || task.due.After(now) {
+			break
+		}
+		heap.Pop(&bj4.queue)
+		if task.Disabled && task.trigger.IsZero() {
+			// a disabled task is due when its TTL passes
+			bj4.removeTask(task.Name)
+			continue
+		}
+		if task.trigger.IsZero() && task.skipMisfire(now) {
+			bj4.saveTask(task)
+			bj4.queue.schedule(task, bj4.taskTTL)
+			continue
+		}
+		heap.Push(&bj4.ready, task)
+	}
+
+	for ; slots > 0 && bj4.ready.Len() > 0; slots-- {
+		heap.Pop(&bj4.ready).(*Task).run()
 	}
 }
 
+// wait blocks until there may be tasks to run, and returns whether the
+// scheduler is stopping.
 func (bj4 *BJ4) wait() bool {
-	t := time.NewTimer(bj4.getWaitTime())
+	bj4.mu.Lock()
+	backlog := bj4.backlog
+	bj4.backlog = nil
+	bj4.mu.Unlock()
+	for _, op := range backlog {
+		op()
+	}
+
+	wt := bj4.getWaitTime()
+	t := bj4.clock.NewTimer(wt)
 	for {
+		bj4.notifyIdle(wt)
 		select {
-		case task := <-bj4.taskAdded:
-			bj4.enqueueTask(task)
-		case <-t.C:
+		case op := <-bj4.opChan:
+			op()
+		case <-t.C():
 			return false
-		case <-bj4.stopChan:
+		case <-bj4.quit:
+			t.Stop()
 			return true
-		case name := <-bj4.removeTaskChan:
-			bj4.removeTask(name)
+		case res := <-bj4.taskDone:
+			t.Stop()
+			bj4.finishTask(res)
+			return false
 		}
 
 		active := t.Stop()
 		if !active {
 			return false
 		}
-		t.Reset(bj4.getWaitTime())
+		wt = bj4.getWaitTime()
+		t.Reset(wt)
+	}
+}
+
+// abandonTasks finishes the running tasks without waiting for them, and
+// returns their names.
+func (bj4 *BJ4) abandonTasks() []string {
+	bj4.mu.Lock()
+	names := make([]string, 0, len(bj4.running))
+	for name := range bj4.running {
+		names = append(names, name)
+	}
+	bj4.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		if task, ok := bj4.tasks[name]; ok && task.live {
+			bj4.finishTask(taskResult{task: task, run: task.runs, abandoned: true})
+			continue
+		}
+		// the task is removed or replaced while running
+		bj4.mu.Lock()
+		delete(bj4.running, name)
+		bj4.mu.Unlock()
+	}
+	return names
+}
+
+// notifyIdle wakes up the callers of WaitIdle if the scheduler is idle, which
+// is when no task is running or due, and no operation is pending.
+func (bj4 *BJ4) notifyIdle(wt time.Duration) {
+	if len(bj4.idleWaiters) == 0 || wt <= 0 || len(bj4.opChan) > 0 || bj4.runningCount() > 0 {
+		return
+	}
+	for _, idle := range bj4.idleWaiters {
+		close(idle)
 	}
+	bj4.idleWaiters = nil
 }
 
 func (bj4 *BJ4) enqueueTask(task *Task) {
+	if old, ok := bj4.tasks[task.Name]; ok {
+		bj4.queue.remove(old)
+		old.dropWaiters()
+	}
+	delete(bj4.pending, task.Name)
 	bj4.tasks[task.Name] = task
+
+	bj4.saveTask(task)
+
+	if bj4.isRunning(task.Name) {
+		// wait for the running task of the same name to be done
+		bj4.pending[task.Name] = task
+		return
+	}
+	bj4.queue.schedule(task, bj4.taskTTL)
+}
+
+func (bj4 *BJ4) finishTask(res taskResult) {
+	if !res.task.live || res.run != res.task.runs {
+		// the result of an abandoned run
+		return
+	}
+	bj4.mu.Lock()
+	if cancel, ok := bj4.running[res.task.Name]; ok {
+		cancel()
+		delete(bj4.running, res.task.Name)
+	}
+	bj4.mu.Unlock()
+
+	task := res.task
+	err := task.finish(res)
+	if res.skipped {
+		if bj4.tasks[task.Name] == task {
+			bj4.saveTask(task)
+		}
+	} else if bj4.tasks[task.Name] == task {
+		record := RunRecord{
+			Started:  task.Started,
+			Finished: task.Completed,
+			Attempt:  task.Attempt,
+			Status:   task.Status,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		task.addHistory(record, bj4.historyLimit)
+		bj4.saveRun(task, record)
+	}
+
+	if next, ok := bj4.pending[task.Name]; ok {
+		delete(bj4.pending, task.Name)
+		bj4.queue.schedule(next, bj4.taskTTL)
+	} else if bj4.tasks[task.Name] == task {
+		bj4.queue.schedule(task, bj4.taskTTL)
+	}
+
+	if perr, ok := res.err.(*PanicError); ok && bj4.panicPolicy == PanicRepanic {
+		panic(perr)
+	}
+}
+
+func (bj4 *BJ4) isRunning(name string) bool {
+	bj4.mu.Lock()
+	defer bj4.mu.Unlock()
+	_, ok := bj4.running[name]
+	return ok
+}
+
+func (bj4 *BJ4) runningCount() int {
+	bj4.mu.Lock()
+	defer bj4.mu.Unlock()
+	return len(bj4.running)
 }
 
 func (bj4 *BJ4) getWaitTime() time.Duration {
 	wt := bj4.minWaitTime
-	now := time.Now()
-	for _, task := range bj4.tasks {
-		if task.NextUpdate.IsZero() {
-			continue
+	if bj4.elector != nil {
+		if t := bj4.nextCampaign.Sub(bj4.clock.Now()); wt > t {
+			wt = t
+		}
+		// nothing can be started until the leadership is acquired
+		if !bj4.leader {
+			return wt
 		}
+	}
+	// nothing can be started until a running task is done, or until
+	// ResumeAll is called
+	if bj4.runningCount() >= bj4.concurrency || bj4.paused {
+		return wt
+	}
 
-		t := task.NextUpdate.Sub(now)
+	if bj4.ready.Len() > 0 {
+		return 0
+	}
+	if task := bj4.queue.peek(); task != nil {
+		t := task.due.Sub(bj4.clock.Now())
 		if wt > t {
 			wt = t
 		}
@@ -176,12 +634,85 @@ func (bj4 *BJ4) getWaitTime() time.Duration {
 }
 
 // SetTask runs the task on the scheduler as soon as possible
-func (bj4 *BJ4) SetTask(name string, fn TaskFunction) <-chan error {
-	return bj4.SetScheduledTask(name, fn, time.Now())
+func (bj4 *BJ4) SetTask(name string, fn TaskFunction, opts ...TaskOption) <-chan error {
+	return bj4.SetScheduledTask(name, fn, bj4.clock.Now(), opts...)
 }
 
 // SetScheduledTask sets the task running on specific time
-func (bj4 *BJ4) SetScheduledTask(name string, fn TaskFunction, nextUpdate time.Time) <-chan error {
+func (bj4 *BJ4) SetScheduledTask(name string, fn TaskFunction, nextUpdate time.Time, opts ...TaskOption) <-chan error {
+	return bj4.setTask(name, WrapTaskFunction(fn), nextUpdate, nil, opts)
+}
+
+// SetCronTask sets the task running on the times described by a cron spec.
+// See ParseSchedule for the accepted formats.  After every run the next
+// activation time is computed from the spec, unless the task function returns
+// a non-zero nextUpdate, which takes precedence for that run.  Returns error
+// if the spec cannot be parsed, or ErrNoActivation if it never activates.
+func (bj4 *BJ4) SetCronTask(name string, spec string, fn TaskFunction, opts ...TaskOption) (<-chan error, error) {
+	return bj4.SetCronContextTask(name, spec, WrapTaskFunction(fn), opts...)
+}
+
+// SetContextTask is like SetTask, but the task function receives a context.
+func (bj4 *BJ4) SetContextTask(name string, fn ContextTaskFunction, opts ...TaskOption) <-chan error {
+	return bj4.SetScheduledContextTask(name, fn, bj4.clock.Now(), opts...)
+}
+
+// SetScheduledContextTask is like SetScheduledTask, but the task function
+// receives a context.
+func (bj4 *BJ4) SetScheduledContextTask(name string, fn ContextTaskFunction, nextUpdate time.Time, opts ...TaskOption) <-chan error {
+	return bj4.setTask(name, fn, nextUpdate, nil, opts)
+}
+
+// SetCronContextTask is like SetCronTask, but the task function receives a
+// context.
+func (bj4 *BJ4) SetCronContextTask(name string, spec string, fn ContextTaskFunction, opts ...TaskOption) (<-chan error, error) {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	next := schedule.Next(bj4.clock.Now())
+	if next.IsZero() {
+		return nil, ErrNoActivation
+	}
+	return bj4.setTask(name, fn, next, schedule, opts), nil
+}
+
+// Register adds a task which is restored from the Store when the scheduler
+// starts.  If the Store has the status of a task of the same name, the task
+// continues from the stored status.  Otherwise it runs on its next cron
+// activation if it has a schedule set with WithSchedule, or as soon as
+// possible if not.  A task whose schedule never activates is added disabled.
+func (bj4 *BJ4) Register(name string, fn ContextTaskFunction, opts ...TaskOption) <-chan error {
+	task := bj4.newTask(name, fn, time.Time{}, nil, opts)
+	if task.schedule != nil {
+		task.NextUpdate = task.schedule.Next(bj4.clock.Now())
+		task.Disabled = task.NextUpdate.IsZero()
+	} else {
+		task.NextUpdate = bj4.clock.Now()
+	}
+
+	bj4.enqueue(func() {
+		bj4.restoreTask(task)
+		bj4.enqueueTask(task)
+	})
+
+	bj4.logger.OnTaskAdded(task)
+
+	return task.errorChan
+}
+
+func (bj4 *BJ4) setTask(name string, fn ContextTaskFunction, nextUpdate time.Time, schedule Schedule, opts []TaskOption) <-chan error {
+	task := bj4.newTask(name, fn, nextUpdate, schedule, opts)
+	bj4.enqueue(func() {
+		bj4.enqueueTask(task)
+	})
+
+	bj4.logger.OnTaskAdded(task)
+
+	return task.errorChan
+}
+
+func (bj4 *BJ4) newTask(name string, fn ContextTaskFunction, nextUpdate time.Time, schedule Schedule, opts []TaskOption) *Task {
 	task := &Task{
 		TaskStatus: TaskStatus{
 			Name:       name,
@@ -189,32 +720,102 @@ func (bj4 *BJ4) SetScheduledTask(name string, fn TaskFunction, nextUpdate time.T
 			Status:     "added",
 		},
 		function:  fn,
+		schedule:  schedule,
 		bj4:       bj4,
 		errorChan: make(chan error, 1),
+		index:     -1,
+		seq:       atomic.AddUint64(&bj4.seq, 1),
 	}
-	bj4.taskAdded <- task
+	for _, opt := range opts {
+		opt(task)
+	}
+	for i := len(bj4.middlewares) - 1; i >= 0; i-- {
+		task.function = bj4.middlewares[i](task.function)
+	}
+	return task
+}
 
-	bj4.logger.OnTaskAdded(task)
+// GetTasks gets the tasks from the scheduler in slice format.  The tasks are
+// read on the goroutine running Start if the scheduler is running, or directly
+// if it is not.
+func (bj4 *BJ4) GetTasks() []TaskStatus {
+	for {
+		bj4.mu.Lock()
+		if bj4.state != stateStarted && bj4.state != stateStopping {
+			defer bj4.mu.Unlock()
+			return bj4.snapshot()
+		}
+		done := bj4.done
+		bj4.mu.Unlock()
 
-	return task.errorChan
+		var taskStatus []TaskStatus
+		err := bj4.do(func() error {
+			taskStatus = bj4.snapshot()
+			return nil
+		})
+		if err == nil {
+			return taskStatus
+		}
+		// the scheduler is stopping; read the tasks once it stops
+		<-done
+	}
 }
 
-// GetTasks gets the tasks from the scheduler in slice format
-func (bj4 *BJ4) GetTasks() []TaskStatus {
-	taskStatus := make([]TaskStatus, len(bj4.tasks))
-	idx := 0
+// snapshot copies the statuses of the tasks.
+func (bj4 *BJ4) snapshot() []TaskStatus {
+	taskStatus := make([]TaskStatus, 0, len(bj4.tasks))
 	for _, task := range bj4.tasks {
-		taskStatus[idx] = task.TaskStatus
-		idx++
+		taskStatus = append(taskStatus, bj4.status(task))
 	}
 	return taskStatus
 }
 
-// RemoveTask removes a task from the scheduler
+// RemoveTask removes a task from the scheduler.  If the task is running, its
+// context is cancelled.
 func (bj4 *BJ4) RemoveTask(name string) {
-	bj4.removeTaskChan <- name
+	bj4.mu.Lock()
+	if cancel, ok := bj4.running[name]; ok {
+		cancel()
+	}
+	bj4.mu.Unlock()
+
+	bj4.enqueue(func() {
+		bj4.removeTask(name)
+	})
+}
+
+// enqueue queues op to run on the goroutine running Start.  It does not block
+// while the scheduler is not started: op is kept until the scheduler starts.
+func (bj4 *BJ4) enqueue(op func()) {
+	for {
+		bj4.mu.Lock()
+		if bj4.state != stateStarted {
+			bj4.backlog = append(bj4.backlog, op)
+			bj4.mu.Unlock()
+			return
+		}
+		quit := bj4.quit
+		bj4.mu.Unlock()
+
+		select {
+		case bj4.opChan <- op:
+			return
+		case <-quit:
+			// stopping; keep op for the next start
+		}
+	}
 }
 
 func (bj4 *BJ4) removeTask(name string) {
-	delete(bj4.tasks, name)
+	if task, ok := bj4.tasks[name]; ok {
+		bj4.queue.remove(task)
+		task.dropWaiters()
+		delete(bj4.tasks, name)
+		if bj4.store != nil {
+			if err := bj4.store.Delete(name); err != nil {
+				bj4.logger.OnStoreError(task, err)
+			}
+		}
+	}
+	delete(bj4.pending, name)
 }
@@ -30,16 +30,48 @@
 package bj4
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func approxDuration(expected, actual time.Duration) bool {
-	return actual < expected+5*time.Millisecond &&
-		actual > expected-5*time.Millisecond
+// nextTimer waits until a timer of the clock is pending, and returns the time
+// the first pending timer fires.
+func nextTimer(clock *FakeClock) time.Time {
+	clock.BlockUntil(1)
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	var first time.Time
+	for timer := range clock.timers {
+		if first.IsZero() || timer.when.Before(first) {
+			first = timer.when
+		}
+	}
+	return first
+}
+
+// sequence records the order the task functions run in.
+type sequence struct {
+	mu  sync.Mutex
+	seq []int64
+}
+
+func (s *sequence) add(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq = append(s.seq, n)
+}
+
+func (s *sequence) get() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.seq...)
 }
 
 func ExampleBJ4_SetTask() {
@@ -52,6 +84,7 @@ func ExampleBJ4_SetTask() {
 	})
 
 	go sch.Start()
+	defer sch.Stop()
 
 	<-errChan // Wait for the task to complete
 
@@ -59,23 +92,27 @@ func ExampleBJ4_SetTask() {
 }
 
 func ExampleBJ4_SetScheduledTask() {
-	sch := New(&Config{})
+	clock := NewFakeClock(time.Now())
+	sch := New(&Config{Clock: clock})
 
 	errChan := sch.SetScheduledTask("hello", func(task *Task) (result string, nextUpdate time.Time, err error) {
 		fmt.Println("Hello World")
 		result = "done"
 		return
-	}, time.Now().Add(3*time.Second))
+	}, clock.Now().Add(3*time.Second))
 
 	go sch.Start()
+	defer sch.Stop()
 
+	clock.Advance(3 * time.Second)
 	<-errChan // Wait for the task to complete
 
 	// Output: Hello World
 }
 
 func ExampleBJ4_SetScheduledTask_repeated() {
-	sch := New(&Config{})
+	clock := NewFakeClock(time.Now())
+	sch := New(&Config{Clock: clock})
 
 	counter := 0
 
@@ -83,13 +120,19 @@ func ExampleBJ4_SetScheduledTask_repeated() {
 		counter++
 		fmt.Println("counter:", counter)
 		result = "done"
-		nextUpdate = time.Now().Add(2 * time.Second)
+		nextUpdate = clock.Now().Add(2 * time.Second)
 		return
-	}, time.Now().Add(3*time.Second))
+	}, clock.Now().Add(3*time.Second))
 
 	go sch.Start()
+	defer sch.Stop()
 
-	time.Sleep(10 * time.Second)
+	// let 10 seconds pass
+	sch.WaitIdle()
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+		sch.WaitIdle()
+	}
 
 	// Output: counter: 1
 	// counter: 2
@@ -98,136 +141,1122 @@ func ExampleBJ4_SetScheduledTask_repeated() {
 }
 
 func TestBJ4(t *testing.T) {
-	var seq []int64
+	var seq sequence
 
-	sch := New(&Config{})
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
 	go sch.Start()
+	defer sch.Stop()
 
 	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
-		seq = append(seq, 1)
+		seq.add(1)
 		return
-	}, time.Now().Add(200*time.Millisecond))
+	}, start.Add(200*time.Millisecond))
 
 	sch.SetScheduledTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
-		seq = append(seq, 2)
+		seq.add(2)
 		return
-	}, time.Now().Add(100*time.Millisecond))
+	}, start.Add(100*time.Millisecond))
 
-	time.Sleep(500 * time.Millisecond)
+	sch.WaitIdle()
+	for i := 0; i < 3; i++ {
+		clock.Advance(100 * time.Millisecond)
+		sch.WaitIdle()
+	}
 
-	if !reflect.DeepEqual(seq, []int64{2, 1}) {
-		t.Error("wrong sequence:", seq)
+	if !reflect.DeepEqual(seq.get(), []int64{2, 1}) {
+		t.Error("wrong sequence:", seq.get())
 	}
 }
 
 func TestMinWaitTime(t *testing.T) {
 	wt := 500 * time.Millisecond
-	sch := New(&Config{MinWaitTime: wt})
-	s := time.Now()
-	sch.wait()
-	d := time.Now().Sub(s)
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock, MinWaitTime: wt})
+	done := make(chan struct{})
+	go func() {
+		sch.wait()
+		close(done)
+	}()
 
-	if !approxDuration(wt, d) {
-		t.Error("wrong duration. expected:", wt, ", actual:", d)
+	if when := nextTimer(clock); !when.Equal(start.Add(wt)) {
+		t.Error("wrong wait time. expected:", wt, ", actual:", when.Sub(start))
 	}
+	clock.Advance(wt)
+	<-done
 }
 
 func TestWait(t *testing.T) {
 	wt := 1000 * time.Millisecond
 	tt := 500 * time.Millisecond
-	sch := New(&Config{MinWaitTime: wt})
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock, MinWaitTime: wt})
 
 	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
 		return
-	}, time.Now().Add(tt))
+	}, start.Add(tt))
 
-	s := time.Now()
-	sch.wait()
-	d := time.Now().Sub(s)
+	done := make(chan struct{})
+	go func() {
+		sch.wait()
+		close(done)
+	}()
 
-	if !approxDuration(tt, d) {
-		t.Error("wrong duration. expected:", tt, ", actual:", d)
+	if when := nextTimer(clock); !when.Equal(start.Add(tt)) {
+		t.Error("wrong wait time. expected:", tt, ", actual:", when.Sub(start))
 	}
+	clock.Advance(tt)
+	<-done
 }
 
 func TestStop(t *testing.T) {
-	var seq []int64
+	var seq sequence
 
-	sch := New(&Config{})
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
 	go sch.Start()
-	time.AfterFunc(200*time.Millisecond, func() {
-		sch.Stop()
-	})
 
 	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
-		seq = append(seq, 1)
+		seq.add(1)
 		return
-	}, time.Now().Add(300*time.Millisecond))
+	}, start.Add(300*time.Millisecond))
 
 	sch.SetScheduledTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
-		seq = append(seq, 2)
+		seq.add(2)
 		return
-	}, time.Now().Add(100*time.Millisecond))
+	}, start.Add(100*time.Millisecond))
 
-	time.Sleep(500 * time.Millisecond)
+	sch.WaitIdle()
+	clock.Advance(200 * time.Millisecond)
+	sch.WaitIdle()
+	sch.Stop()
+	clock.Advance(300 * time.Millisecond)
 
-	if !reflect.DeepEqual(seq, []int64{2}) {
-		t.Error("wrong sequence:", seq)
+	if !reflect.DeepEqual(seq.get(), []int64{2}) {
+		t.Error("wrong sequence:", seq.get())
 	}
 }
 
 func TestStopWaitsCurrentTaskDone(t *testing.T) {
-	var count int
-	var wg sync.WaitGroup
+	var count atomic.Int32
 
 	sch := New(&Config{})
 	go sch.Start()
 
-	wg.Add(1)
-	// will fire after 400 ms
+	started := make(chan struct{})
+	release := make(chan struct{})
+	sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		<-release
+		count.Add(1)
+		return
+	})
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		sch.Stop()
+		close(stopped)
+	}()
+	// WaitIdle returns once the scheduler is stopping
+	if err := sch.WaitIdle(); err != ErrNotStarted {
+		t.Error("expected ErrNotStarted, actual:", err)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("Stop() returns while the Task is running")
+	default:
+	}
+	close(release)
+	<-stopped
+
+	// Stop should guarantee on-going Task is done
+	if count.Load() != 1 {
+		t.Error("Stop() doesn't wait for on-going Task done")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	var seq sequence
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
 	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
-		defer wg.Done()
-		time.Sleep(time.Millisecond * 300)
-		count++
+		seq.add(1)
 		return
-	}, time.Now().Add(100*time.Millisecond))
+	}, start.Add(300*time.Millisecond))
 
-	wg.Add(1)
-	time.AfterFunc(200*time.Millisecond, func() {
-		defer wg.Done()
+	sch.SetScheduledTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		seq.add(2)
+		return
+	}, start.Add(100*time.Millisecond))
 
-		sch.Stop()
+	sch.RemoveTask("1")
+
+	sch.WaitIdle()
+	for i := 0; i < 5; i++ {
+		clock.Advance(100 * time.Millisecond)
+		sch.WaitIdle()
+	}
+
+	if !reflect.DeepEqual(seq.get(), []int64{2}) {
+		t.Error("wrong sequence:", seq.get())
+	}
+}
+
+func TestAddBeforeStart(t *testing.T) {
+	var runs atomic.Int32
+	fn := func(task *Task) (result string, nextUpdate time.Time, err error) {
+		runs.Add(1)
+		return
+	}
 
-		// Stop should guarantee on-going Task is done
-		if count != 1 {
-			t.Error("Stop() doesn't wait for on-going Task done")
+	// adding more tasks than the operations the scheduler buffers does not
+	// block before Start
+	sch := New(&Config{})
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		for i := 0; i < 100; i++ {
+			sch.SetTask(strconv.Itoa(i), fn)
+			sch.Register("r"+strconv.Itoa(i), func(ctx context.Context, task *Task) (string, time.Time, error) {
+				return fn(task)
+			})
 		}
+		sch.RemoveTask("0")
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("adding tasks before Start should not block")
+	}
+
+	go sch.Start()
+	defer sch.Stop()
+	sch.WaitIdle()
+	if n := runs.Load(); n != 199 {
+		t.Error("wrong runs:", n)
+	}
+	if _, err := sch.GetTask("0"); err != ErrTaskNotFound {
+		t.Error("removed task should not exist:", err)
+	}
+}
+
+func TestCronTask(t *testing.T) {
+	var runs []time.Time
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	_, err := sch.SetCronTask("1", "@every 100ms", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		runs = append(runs, clock.Now())
+		return
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	wg.Wait()
+	sch.WaitIdle()
+	for i := 0; i < 3; i++ {
+		clock.Advance(100 * time.Millisecond)
+		sch.WaitIdle()
+	}
+	expected := []time.Time{
+		start.Add(100 * time.Millisecond),
+		start.Add(200 * time.Millisecond),
+		start.Add(300 * time.Millisecond),
+	}
+	if !reflect.DeepEqual(runs, expected) {
+		t.Error("wrong runs. expected:", expected, ", actual:", runs)
+	}
+
+	if _, err := sch.SetCronTask("2", "* * *", nil); err == nil {
+		t.Error("expected error on invalid spec")
+	}
+
+	// February 30th never comes
+	if _, err := sch.SetCronTask("3", "0 0 30 2 *", nil); err != ErrNoActivation {
+		t.Error("expected ErrNoActivation, actual:", err)
+	}
+	never, _ := ParseSchedule("0 0 30 2 *")
+	sch.Register("4", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		t.Error("task which never activates should not run")
+		return
+	}, WithSchedule(never))
+	if status, err := sch.GetTask("4"); err != nil || !status.Disabled {
+		t.Error("task which never activates should be disabled:", status, err)
+	}
 }
 
-func TestRemove(t *testing.T) {
-	var seq []int64
+func TestContextCancelledOnStop(t *testing.T) {
+	var ctxErr error
 
 	sch := New(&Config{})
 	go sch.Start()
 
-	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
-		seq = append(seq, 1)
+	started := make(chan struct{})
+	sch.SetContextTask("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		ctxErr = ctx.Err()
 		return
-	}, time.Now().Add(300*time.Millisecond))
+	})
 
-	sch.SetScheduledTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
-		seq = append(seq, 2)
+	<-started
+	sch.Stop()
+
+	if ctxErr != context.Canceled {
+		t.Error("context not cancelled on Stop:", ctxErr)
+	}
+}
+
+func TestContextCancelledOnRemove(t *testing.T) {
+	sch := New(&Config{})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	sch.SetContextTask("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		done <- ctx.Err()
 		return
-	}, time.Now().Add(100*time.Millisecond))
+	})
 
+	<-started
 	sch.RemoveTask("1")
 
-	time.Sleep(500 * time.Millisecond)
+	if err := <-done; err != context.Canceled {
+		t.Error("context not cancelled on RemoveTask:", err)
+	}
+}
+
+func TestContextTimeout(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan context.Context)
+	sch.SetContextTask("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		started <- ctx
+		<-ctx.Done()
+		return
+	}, WithTimeout(100*time.Millisecond))
+
+	ctx := <-started
+	clock.Advance(100*time.Millisecond - 1)
+	if err := ctx.Err(); err != nil {
+		t.Error("context done before its deadline:", err)
+	}
+	clock.Advance(1)
+	<-ctx.Done()
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		t.Error("context deadline not exceeded:", err)
+	}
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(start.Add(100*time.Millisecond)) {
+		t.Error("wrong deadline:", deadline, ok)
+	}
+}
+
+func TestTaskTimeout(t *testing.T) {
+	var seq sequence
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock, TaskTimeout: 100 * time.Millisecond})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	errChan := sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		seq.add(1)
+		close(started)
+		<-hang
+		return
+	}, start.Add(100*time.Millisecond))
+
+	sch.SetScheduledTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		seq.add(2)
+		return
+	}, start.Add(150*time.Millisecond), WithTimeout(time.Second))
+
+	sch.WaitIdle()
+	clock.Advance(100 * time.Millisecond)
+	<-started
+	clock.Advance(100 * time.Millisecond)
+	if err := <-errChan; err != ErrTaskTimeout {
+		t.Error("expected ErrTaskTimeout, actual:", err)
+	}
+	sch.WaitIdle()
+
+	if !reflect.DeepEqual(seq.get(), []int64{1, 2}) {
+		t.Error("wrong sequence:", seq.get())
+	}
+	// the task without a schedule runs again after MinWaitTime
+	completed := start.Add(200 * time.Millisecond)
+	status, _ := sch.GetTask("1")
+	if status.Disabled || status.Status != "timeout: exceeded 100ms" ||
+		!status.Completed.Equal(completed) || !status.NextUpdate.Equal(completed.Add(minWaitTime)) {
+		t.Error("wrong status of timed out task:", status)
+	}
+}
+
+// TestTimedOutSnapshot is meant to be run with -race.
+func TestTimedOutSnapshot(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	sch := New(&Config{Clock: clock, TaskTimeout: time.Minute})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan struct{})
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	var runs atomic.Int32
+	errChan := sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		if runs.Add(1) > 1 {
+			return
+		}
+		// the timed out run keeps reading the task while it runs again
+		defer close(stopped)
+		close(started)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				task.Snapshot()
+				task.FencingToken()
+				task.Triggered()
+			}
+		}
+	})
+	<-started
+	clock.Advance(time.Minute)
+	if err := <-errChan; err != ErrTaskTimeout {
+		t.Error("expected ErrTaskTimeout, actual:", err)
+	}
+	clock.Advance(minWaitTime)
+	if err := <-errChan; err != nil {
+		t.Error("unexpected error:", err)
+	}
+	close(stop)
+	<-stopped
+}
+
+func TestPanicRecover(t *testing.T) {
+	var seq sequence
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	errChan := sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		seq.add(1)
+		panic("oops")
+	}, start.Add(100*time.Millisecond))
+
+	sch.SetScheduledTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		seq.add(2)
+		return
+	}, start.Add(200*time.Millisecond))
+
+	sch.WaitIdle()
+	clock.Advance(100 * time.Millisecond)
+	err := <-errChan
+	panicErr, ok := err.(*PanicError)
+	if !ok {
+		t.Fatal("expected *PanicError, actual:", err)
+	}
+	if panicErr.Value != "oops" || len(panicErr.Stack) == 0 {
+		t.Error("wrong panic error:", panicErr.Value, string(panicErr.Stack))
+	}
+
+	sch.WaitIdle()
+	clock.Advance(100 * time.Millisecond)
+	sch.WaitIdle()
+
+	if !reflect.DeepEqual(seq.get(), []int64{1, 2}) {
+		t.Error("wrong sequence:", seq.get())
+	}
+	if status, _ := sch.GetTask("1"); status.Disabled || !status.NextUpdate.Equal(status.Completed.Add(minWaitTime)) {
+		t.Error("task without a schedule should run again after MinWaitTime:", status)
+	}
+}
+
+func TestPanicRecoverKeepsInterval(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	var runs atomic.Int32
+	sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		if runs.Add(1) == 1 {
+			return "", clock.Now().Add(10 * time.Minute), nil
+		}
+		panic("oops")
+	})
+	sch.WaitIdle()
+
+	// the task keeps running every 10 minutes while it panics
+	for i := int32(2); i <= 3; i++ {
+		clock.Advance(10 * time.Minute)
+		sch.WaitIdle()
+		status, _ := sch.GetTask("1")
+		if n := runs.Load(); n != i || status.Disabled || !status.NextUpdate.Equal(clock.Now().Add(10*time.Minute)) {
+			t.Error("wrong status of panicked task:", n, status)
+		}
+	}
+}
+
+func TestPanicRecoverAndDisable(t *testing.T) {
+	var count int32
+
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	sch := New(&Config{Clock: clock, PanicPolicy: PanicRecoverAndDisable})
+	go sch.Start()
+	defer sch.Stop()
+
+	sch.SetCronTask("1", "@every 100ms", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		atomic.AddInt32(&count, 1)
+		panic("oops")
+	})
+
+	sch.WaitIdle()
+	for i := 0; i < 4; i++ {
+		clock.Advance(100 * time.Millisecond)
+		sch.WaitIdle()
+	}
+
+	if count := atomic.LoadInt32(&count); count != 1 {
+		t.Error("panicking task should be disabled, but ran", count, "times")
+	}
+}
+
+func TestPanicRepanic(t *testing.T) {
+	sch := New(&Config{PanicPolicy: PanicRepanic})
+
+	recovered := make(chan interface{})
+	go func() {
+		defer func() {
+			recovered <- recover()
+		}()
+		sch.Start()
+	}()
+
+	errChan := sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		panic("oops")
+	})
+
+	if _, ok := (<-errChan).(*PanicError); !ok {
+		t.Error("expected *PanicError on error channel")
+	}
+	if _, ok := (<-recovered).(*PanicError); !ok {
+		t.Error("expected Start to panic with *PanicError")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var running, maxRunning int32
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock, Concurrency: 2})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan struct{})
+	var errChans []<-chan error
+	for _, name := range []string{"1", "2", "3"} {
+		errChans = append(errChans, sch.SetTask(name, func(task *Task) (result string, nextUpdate time.Time, err error) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			timer := clock.NewTimer(200 * time.Millisecond)
+			started <- struct{}{}
+			<-timer.C()
+			atomic.AddInt32(&running, -1)
+			return
+		}))
+	}
+
+	// two tasks run at first, and the third once one of them is done
+	<-started
+	<-started
+	clock.Advance(200 * time.Millisecond)
+	<-errChans[0]
+	<-errChans[1]
+	<-started
+	clock.Advance(200 * time.Millisecond)
+	<-errChans[2]
 
-	if !reflect.DeepEqual(seq, []int64{2}) {
+	if maxRunning != 2 {
+		t.Error("wrong number of tasks running at the same time:", maxRunning)
+	}
+	for _, status := range sch.GetTasks() {
+		completed := start.Add(200 * time.Millisecond)
+		if status.Name == "3" {
+			completed = start.Add(400 * time.Millisecond)
+		}
+		if !status.Completed.Equal(completed) {
+			t.Error("wrong completion time:", status.Name, status.Completed.Sub(start))
+		}
+	}
+}
+
+func TestConcurrencyNoOverlap(t *testing.T) {
+	var running, count int32
+
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	sch := New(&Config{Clock: clock, Concurrency: 4})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	sch.SetCronContextTask("1", "@every 10ms", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			t.Error("task overlaps with itself")
+		}
+		defer atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&count, 1)
+		select {
+		case started <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return
+	})
+
+	// the task falls due several times while it is running
+	sch.WaitIdle()
+	for i := 0; i < 4; i++ {
+		clock.Advance(10 * time.Millisecond)
+		<-started
+		for j := 0; j < 5; j++ {
+			clock.Advance(10 * time.Millisecond)
+		}
+		release <- struct{}{}
+		sch.WaitIdle()
+	}
+
+	if count := atomic.LoadInt32(&count); count != 4 {
+		t.Error("task ran a wrong number of times:", count)
+	}
+}
+
+func TestStopWaitsAllRunningTasksDone(t *testing.T) {
+	var count int32
+
+	sch := New(&Config{Concurrency: 3})
+	go sch.Start()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	for _, name := range []string{"1", "2", "3"} {
+		sch.SetTask(name, func(task *Task) (result string, nextUpdate time.Time, err error) {
+			started <- struct{}{}
+			<-release
+			atomic.AddInt32(&count, 1)
+			return
+		})
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		sch.Stop()
+		close(stopped)
+	}()
+	// WaitIdle returns once the scheduler is stopping
+	sch.WaitIdle()
+	close(release)
+	<-stopped
+
+	if count := atomic.LoadInt32(&count); count != 3 {
+		t.Error("Stop() doesn't wait for all on-going Tasks done:", count)
+	}
+}
+
+func TestOrderOfTasksDueAtSameTime(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		var seq []string
+
+		start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := NewFakeClock(start)
+		sch := New(&Config{Clock: clock})
+		at := start.Add(50 * time.Millisecond)
+		for _, task := range []struct {
+			name     string
+			at       time.Time
+			priority int
+		}{
+			{"a", at, 0},
+			{"b", at, 5},
+			{"c", at, 0},
+			{"d", at, 5},
+			{"e", at.Add(-30 * time.Millisecond), 0},
+			{"f", at.Add(100 * time.Millisecond), 9},
+		} {
+			name := task.name
+			sch.SetScheduledTask(name, func(task *Task) (result string, nextUpdate time.Time, err error) {
+				seq = append(seq, name)
+				return
+			}, task.at, WithPriority(task.priority))
+		}
+
+		go sch.Start()
+		sch.WaitIdle()
+		for _, d := range []time.Duration{20 * time.Millisecond, 30 * time.Millisecond, 100 * time.Millisecond} {
+			clock.Advance(d)
+			sch.WaitIdle()
+		}
+		sch.Stop()
+
+		if !reflect.DeepEqual(seq, []string{"e", "b", "d", "a", "c", "f"}) {
+			t.Fatal("wrong sequence:", seq)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	for _, c := range []struct {
+		agingThreshold time.Duration
+		expected       []string
+	}{
+		{0, []string{"blocker", "high", "low"}},
+		{40 * time.Millisecond, []string{"blocker", "low", "high"}},
+	} {
+		var seq []string
+
+		start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := NewFakeClock(start)
+		sch := New(&Config{Clock: clock, AgingThreshold: c.agingThreshold})
+
+		// the blocker runs until both of the other tasks are due
+		started := make(chan struct{})
+		release := make(chan struct{})
+		sch.SetTask("blocker", func(task *Task) (result string, nextUpdate time.Time, err error) {
+			seq = append(seq, "blocker")
+			close(started)
+			<-release
+			return
+		})
+		for _, task := range []struct {
+			name     string
+			at       time.Time
+			priority int
+		}{
+			{"low", start.Add(10 * time.Millisecond), 0},
+			{"high", start.Add(150 * time.Millisecond), 2},
+		} {
+			name := task.name
+			sch.SetScheduledTask(name, func(task *Task) (result string, nextUpdate time.Time, err error) {
+				seq = append(seq, name)
+				return
+			}, task.at, WithPriority(task.priority))
+		}
+
+		go sch.Start()
+		<-started
+		clock.Advance(200 * time.Millisecond)
+		close(release)
+		sch.WaitIdle()
+		sch.Stop()
+
+		if !reflect.DeepEqual(seq, c.expected) {
+			t.Error("wrong sequence with aging threshold", c.agingThreshold, ":", seq)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var attempts []int
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	errChan := sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		attempts = append(attempts, task.Attempt)
+		if task.Attempt < 3 {
+			err = fmt.Errorf("attempt %d failed", task.Attempt)
+		}
+		return
+	}, WithRetry(RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: 50 * time.Millisecond,
+	}))
+
+	// the delay doubles after every attempt
+	sch.WaitIdle()
+	for _, d := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond} {
+		status, _ := sch.GetTask("1")
+		if !status.Retrying || !status.NextUpdate.Equal(clock.Now().Add(d)) {
+			t.Error("wrong retry of attempt", status.Attempt, ":", status)
+		}
+		clock.Advance(d)
+		sch.WaitIdle()
+	}
+
+	if err := <-errChan; err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 2, 3}) {
+		t.Error("wrong attempts:", attempts)
+	}
+	if status, _ := sch.GetTask("1"); !status.Completed.Equal(start.Add(150 * time.Millisecond)) {
+		t.Error("wrong completion time:", status.Completed.Sub(start))
+	}
+
+	errChan = sch.SetTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		err = fmt.Errorf("attempt %d failed", task.Attempt)
+		return
+	}, WithRetry(RetryPolicy{
+		MaxAttempts:  2,
+		InitialDelay: 50 * time.Millisecond,
+	}))
+	sch.WaitIdle()
+	clock.Advance(50 * time.Millisecond)
+
+	if err := <-errChan; err == nil || err.Error() != "attempt 2 failed" {
+		t.Error("wrong error after retries are exhausted:", err)
+	}
+}
+
+type contextKey string
+
+func TestMiddlewares(t *testing.T) {
+	var seq []string
+	mw := func(name string) TaskMiddleware {
+		return func(next ContextTaskFunction) ContextTaskFunction {
+			return func(ctx context.Context, task *Task) (string, time.Time, error) {
+				seq = append(seq, name)
+				return next(context.WithValue(ctx, contextKey(name), true), task)
+			}
+		}
+	}
+
+	sch := New(&Config{Middlewares: []TaskMiddleware{mw("outer"), mw("inner")}})
+	go sch.Start()
+	defer sch.Stop()
+
+	<-sch.SetContextTask("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		if ctx.Value(contextKey("outer")) == nil || ctx.Value(contextKey("inner")) == nil {
+			t.Error("task should receive the context of the middlewares")
+		}
+		seq = append(seq, "task")
+		return
+	})
+
+	if !reflect.DeepEqual(seq, []string{"outer", "inner", "task"}) {
 		t.Error("wrong sequence:", seq)
 	}
 }
+
+// snapshotLogger reads the status of tasks from the callbacks.
+type snapshotLogger struct {
+	NilLogger
+	mu       sync.Mutex
+	statuses []string
+}
+
+func (lgr *snapshotLogger) add(task *Task) {
+	status := task.Snapshot().Status
+	lgr.mu.Lock()
+	defer lgr.mu.Unlock()
+	lgr.statuses = append(lgr.statuses, status)
+}
+
+func (lgr *snapshotLogger) OnTaskStatusUpdate(task *Task) {
+	lgr.add(task)
+}
+
+func (lgr *snapshotLogger) OnTaskComplete(task *Task, result string) {
+	lgr.add(task)
+}
+
+func TestLoggerSnapshot(t *testing.T) {
+	lgr := &snapshotLogger{}
+	sch := New(&Config{Logger: lgr})
+	go sch.Start()
+	defer sch.Stop()
+
+	errChan := sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		task.SetStatus("working")
+		return "done", time.Time{}, nil
+	})
+	select {
+	case <-errChan:
+	case <-time.After(time.Second):
+		t.Fatal("the scheduler is deadlocked by the logger")
+	}
+	lgr.mu.Lock()
+	defer lgr.mu.Unlock()
+	if !reflect.DeepEqual(lgr.statuses, []string{"working", "completed: done"}) {
+		t.Error("wrong statuses:", lgr.statuses)
+	}
+}
+
+// TestConcurrentAccess is meant to be run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	sch := New(&Config{Concurrency: 4})
+	go sch.Start()
+
+	fn := func(task *Task) (result string, nextUpdate time.Time, err error) {
+		task.SetStatus("working")
+		nextUpdate = time.Now().Add(time.Millisecond)
+		return
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				name := fmt.Sprint(i, "-", n%8)
+				switch n % 3 {
+				case 0:
+					sch.SetTask(name, fn)
+				case 1:
+					sch.RemoveTask(name)
+				default:
+					for _, status := range sch.GetTasks() {
+						_ = status.Status
+					}
+				}
+			}
+		}(i)
+	}
+
+	// stop and restart the scheduler while the tasks are changed
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if err := sch.Stop(); err != nil {
+			t.Error("failed to stop:", err)
+		}
+		if err := sch.Stop(); err != ErrNotStarted {
+			t.Error("expected ErrNotStarted on stopping twice, actual:", err)
+		}
+		sch.GetTasks()
+		go sch.Start()
+		for _, err := sch.GetTask(""); err == ErrNotStarted; _, err = sch.GetTask("") {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// keep the scheduler running for the pending SetTask to return
+	close(stop)
+	wg.Wait()
+	sch.Stop()
+}
+
+func TestRun(t *testing.T) {
+	sch := New(&Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	errChan := sch.SetContextTask("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		<-ctx.Done()
+		return
+	})
+
+	ret := make(chan error)
+	go func() {
+		ret <- sch.Run(ctx)
+	}()
+	<-started
+	cancel()
+
+	if err := <-ret; err != context.Canceled {
+		t.Error("expected context.Canceled, actual:", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Error("task should return on cancel:", err)
+	}
+	if err := sch.Stop(); err != ErrNotStarted {
+		t.Error("expected ErrNotStarted, actual:", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock, Concurrency: 2})
+	go sch.Start()
+
+	var ran int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	errChan := sch.SetContextTask("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		<-release
+		err = ctx.Err()
+		return
+	})
+	sch.SetScheduledTask("2", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		atomic.AddInt32(&ran, 1)
+		return
+	}, start.Add(50*time.Millisecond))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result := make(chan error)
+	go func() {
+		result <- sch.Shutdown(ctx)
+	}()
+	// WaitIdle returns once the scheduler is stopping
+	sch.WaitIdle()
+	clock.Advance(50 * time.Millisecond)
+	close(release)
+
+	if err := <-result; err != nil {
+		t.Error("failed to shut down:", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Error("running task should not be cancelled:", err)
+	}
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Error("task should not start once shutting down")
+	}
+	if err := sch.Shutdown(ctx); err != ErrNotStarted {
+		t.Error("expected ErrNotStarted, actual:", err)
+	}
+}
+
+func TestShutdownAbandons(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+
+	started := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	errChan := sch.SetTask("hung", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		<-hang
+		return
+	})
+	<-started
+
+	ctx, cancel := withTimeout(context.Background(), clock, 100*time.Millisecond)
+	defer cancel()
+	result := make(chan error)
+	go func() {
+		result <- sch.Shutdown(ctx)
+	}()
+	clock.Advance(100*time.Millisecond - 1)
+	select {
+	case err := <-result:
+		t.Fatal("Shutdown returned before its context is done:", err)
+	default:
+	}
+	clock.Advance(1)
+	err := <-result
+
+	shutdownErr, ok := err.(*ShutdownError)
+	if !ok {
+		t.Fatal("expected *ShutdownError, actual:", err)
+	}
+	if !reflect.DeepEqual(shutdownErr.Tasks, []string{"hung"}) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("wrong shutdown error:", err)
+	}
+	if err := <-errChan; err != ErrTaskAbandoned {
+		t.Error("expected ErrTaskAbandoned, actual:", err)
+	}
+	tasks := sch.GetTasks()
+	if len(tasks) != 1 || tasks[0].Status != statusAbandoned || tasks[0].Disabled ||
+		!tasks[0].Completed.Equal(start.Add(100*time.Millisecond)) {
+		t.Error("wrong status of abandoned task:", tasks)
+	}
+}
+
+func TestAbandonedResult(t *testing.T) {
+	sch := New(&Config{})
+	go sch.Start()
+
+	started := make(chan string)
+	stale := make(chan struct{})
+	fresh := make(chan struct{})
+	var calls atomic.Int32
+	sch.SetTask("a", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		if calls.Add(1) == 1 {
+			started <- "stale"
+			<-stale
+			return "stale", time.Time{}, errors.New("stale")
+		}
+		started <- "fresh"
+		<-fresh
+		return "fresh", time.Now().Add(time.Hour), nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := sch.Shutdown(ctx).(*ShutdownError); !ok {
+		t.Fatal("the run should be abandoned")
+	}
+
+	// the abandoned run returns while the task runs again
+	go sch.Start()
+	defer sch.Stop()
+	if run := <-started; run != "fresh" {
+		t.Fatal("wrong run:", run)
+	}
+	close(stale)
+	time.Sleep(50 * time.Millisecond)
+	if status, _ := sch.GetTask("a"); status.Status != statusRunning {
+		t.Error("the result of the abandoned run should be dropped:", status)
+	}
+	close(fresh)
+	sch.WaitIdle()
+	if status, _ := sch.GetTask("a"); status.Status != "completed: fresh" || status.Disabled {
+		t.Error("wrong status:", status)
+	}
+}
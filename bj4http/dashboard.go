@@ -0,0 +1,138 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4http
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"pathEscape": url.PathEscape,
+	"formatTime": formatTime,
+	"duration": func(record bj4.RunRecord) string {
+		if record.Started.IsZero() || record.Finished.IsZero() {
+			return "-"
+		}
+		return record.Finished.Sub(record.Started).Round(time.Millisecond).String()
+	},
+}).Parse(dashboardHTML))
+
+// dashboardRefresh is the interval the dashboard page reloads itself.
+const dashboardRefresh = 5
+
+type dashboard struct {
+	sch *bj4.BJ4
+}
+
+type dashboardTask struct {
+	bj4.TaskStatus
+	History []bj4.RunRecord
+}
+
+// NewDashboard creates a handler serving an HTML page which shows the
+// statuses and the latest runs of the tasks of the scheduler, with buttons to
+// run, pause, resume and remove them.  The page reloads itself every few
+// seconds.  The handler serves the page at "/", and the buttons post to
+// "/tasks/{name}/{action}"; use http.StripPrefix or Mount to serve it under
+// a prefix.  The middlewares wrap the handler as in NewHandler.
+func NewDashboard(sch *bj4.BJ4, middlewares ...Middleware) http.Handler {
+	d := &dashboard{sch: sch}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", d.page)
+	mux.HandleFunc("POST /tasks/{name}/run", d.action(trigger(sch)))
+	mux.HandleFunc("POST /tasks/{name}/pause", d.action(sch.PauseTask))
+	mux.HandleFunc("POST /tasks/{name}/resume", d.action(sch.ResumeTask))
+	mux.HandleFunc("POST /tasks/{name}/remove", d.action(func(name string) error {
+		sch.RemoveTask(name)
+		return nil
+	}))
+	return wrap(sameOrigin(mux), middlewares)
+}
+
+// Mount serves the dashboard at prefix, and the JSON API at prefix + "/api",
+// on mux.  prefix must not end with a slash, e.g. "/bj4".
+func Mount(mux *http.ServeMux, prefix string, sch *bj4.BJ4, middlewares ...Middleware) {
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, NewDashboard(sch, middlewares...)))
+	mux.Handle(prefix+"/api/", http.StripPrefix(prefix+"/api", NewHandler(sch, middlewares...)))
+}
+
+func (d *dashboard) page(w http.ResponseWriter, r *http.Request) {
+	statuses := d.sch.GetTasks()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	tasks := make([]dashboardTask, 0, len(statuses))
+	for _, status := range statuses {
+		// the task may be removed since the list is taken
+		history, _ := d.sch.GetHistory(status.Name)
+		tasks = append(tasks, dashboardTask{TaskStatus: status, History: history})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, map[string]interface{}{
+		"Refresh": dashboardRefresh,
+		"Now":     time.Now(),
+		"Tasks":   tasks,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// action serves a button on the page, and redirects back to the page.
+func (d *dashboard) action(op func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := op(r.PathValue("name")); err != nil {
+			writeError(w, err)
+			return
+		}
+		// relative to the URL requested, which has the prefix
+		// http.StripPrefix removes from r.URL
+		w.Header().Set("Location", "../../")
+		w.WriteHeader(http.StatusSeeOther)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,133 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+func TestDashboard(t *testing.T) {
+	sch := bj4.New(&bj4.Config{})
+	go sch.Start()
+	defer sch.Stop()
+
+	errChan := sch.SetTask("a&b", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		result = "done"
+		nextUpdate = time.Now().Add(time.Hour)
+		return
+	})
+	<-errChan
+
+	mux := http.NewServeMux()
+	Mount(mux, "/bj4", sch)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/bj4/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	page := string(body)
+	for _, s := range []string{
+		"a&amp;b",
+		"completed: done",
+		"attempt 1: completed: done",
+		`action="tasks/a&amp;b/pause"`,
+		`http-equiv="refresh"`,
+	} {
+		if !strings.Contains(page, s) {
+			t.Errorf("page does not contain %q:\n%s", s, page)
+		}
+	}
+
+	// the buttons redirect back to the page
+	res, err = http.Post(srv.URL+"/bj4/tasks/a&b/pause", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Request.URL.Path != "/bj4/" || res.StatusCode != http.StatusOK {
+		t.Error("wrong redirect:", res.Request.URL, res.StatusCode)
+	}
+	if status, _ := sch.GetTask("a&b"); !status.Paused {
+		t.Error("task should be paused:", status)
+	}
+
+	// a form on another site cannot post with the credentials of the user
+	for _, header := range [][2]string{
+		{"Origin", "http://evil.example"},
+		{"Sec-Fetch-Site", "cross-site"},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/bj4/tasks/a&b/resume", nil)
+		req.Header.Set(header[0], header[1])
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Error("cross-origin request should be rejected:", header, res.StatusCode)
+		}
+	}
+	if status, _ := sch.GetTask("a&b"); !status.Paused {
+		t.Error("task should stay paused:", status)
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/bj4/tasks/a&b/resume", nil)
+	req.Header.Set("Origin", srv.URL)
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if status, _ := sch.GetTask("a&b"); status.Paused {
+		t.Error("same-origin request should be served:", res.StatusCode, status)
+	}
+
+	// the API is mounted as well
+	res, err = http.Get(srv.URL + "/bj4/api/tasks/a&b/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), `"Status":"completed: done"`) {
+		t.Error("wrong history:", res.StatusCode, string(body))
+	}
+}
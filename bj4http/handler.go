@@ -0,0 +1,186 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package bj4http provides an http.Handler for inspecting and controlling a
+// bj4 scheduler with a JSON API.
+//
+// The handler serves the following endpoints, relative to where it is
+// mounted:
+//
+//	GET    /tasks                   lists the statuses of all tasks
+//	GET    /tasks/{name}            gets the status of a task
+//	GET    /tasks/{name}/history    gets the records of the latest runs of a
+//	                                task, the latest first
+//	POST   /tasks/{name}/trigger    runs a task as soon as possible
+//	POST   /tasks/{name}/pause      pauses a task
+//	POST   /tasks/{name}/resume     resumes a paused task
+//	POST   /tasks/{name}/reschedule moves the next update time of a task to
+//	                                the time in the body, {"at": "<RFC 3339>"}
+//	DELETE /tasks/{name}            removes a task
+//
+// Task statuses are encoded as JSON objects with the fields of
+// bj4.TaskStatus.  Errors are encoded as {"error": "<message>"}.
+package bj4http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+// Middleware wraps a handler, e.g. to authenticate the requests.
+type Middleware func(http.Handler) http.Handler
+
+// wrap wraps the handler with the middlewares in order, so the first one sees
+// a request first.
+func wrap(handler http.Handler, middlewares []Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+type handler struct {
+	sch *bj4.BJ4
+}
+
+// NewHandler creates a handler serving the API of the scheduler.  The
+// middlewares wrap the handler in order, so the first one sees a request
+// first.
+func NewHandler(sch *bj4.BJ4, middlewares ...Middleware) http.Handler {
+	h := &handler{sch: sch}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tasks", h.list)
+	mux.HandleFunc("GET /tasks/{name}", h.get)
+	mux.HandleFunc("GET /tasks/{name}/history", h.history)
+	mux.HandleFunc("POST /tasks/{name}/trigger", h.action(trigger(sch)))
+	mux.HandleFunc("POST /tasks/{name}/pause", h.action(sch.PauseTask))
+	mux.HandleFunc("POST /tasks/{name}/resume", h.action(sch.ResumeTask))
+	mux.HandleFunc("POST /tasks/{name}/reschedule", h.reschedule)
+	mux.HandleFunc("DELETE /tasks/{name}", h.remove)
+
+	return wrap(sameOrigin(mux), middlewares)
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	statuses := h.sch.GetTasks()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	status, err := h.sch.GetTask(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (h *handler) history(w http.ResponseWriter, r *http.Request) {
+	records, err := h.sch.GetHistory(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// action serves an operation on a task, and responds with the status of the
+// task after the operation.
+func (h *handler) action(op func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := op(name); err != nil {
+			writeError(w, err)
+			return
+		}
+		h.get(w, r)
+	}
+}
+
+// trigger adapts TriggerTask to an action, which does not wait for the
+// triggered run.
+func trigger(sch *bj4.BJ4) func(name string) error {
+	return func(name string) error {
+		_, err := sch.TriggerTask(name)
+		return err
+	}
+}
+
+func (h *handler) reschedule(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		At time.Time `json:"at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.At.IsZero() {
+		writeJSON(w, http.StatusBadRequest, errorBody{"body must be {\"at\": \"<RFC 3339 time>\"}"})
+		return
+	}
+	h.action(func(name string) error {
+		_, err := h.sch.RescheduleTask(name, body.At)
+		return err
+	})(w, r)
+}
+
+func (h *handler) remove(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, err := h.sch.GetTask(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	h.sch.RemoveTask(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, bj4.ErrTaskNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, bj4.ErrNotStarted):
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, errorBody{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
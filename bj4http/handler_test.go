@@ -0,0 +1,167 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+func serve(t *testing.T, h http.Handler, method, path, body string) (*httptest.ResponseRecorder, bj4.TaskStatus) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var status bj4.TaskStatus
+	if rec.Code == http.StatusOK && !strings.HasSuffix(path, "/tasks") {
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, status
+}
+
+func TestHandler(t *testing.T) {
+	sch := bj4.New(&bj4.Config{})
+	go sch.Start()
+	defer sch.Stop()
+
+	runs := make(chan struct{}, 10)
+	fn := func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		runs <- struct{}{}
+		return
+	}
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	sch.SetScheduledTask("a", fn, later)
+	sch.SetScheduledTask("b/c", fn, later)
+	h := NewHandler(sch)
+	sch.WaitIdle()
+
+	rec, status := serve(t, h, "GET", "/tasks/b%2Fc", "")
+	if rec.Code != http.StatusOK || status.Name != "b/c" || !status.NextUpdate.Equal(later) {
+		t.Error("wrong task:", rec.Code, rec.Body.String())
+	}
+
+	rec, _ = serve(t, h, "GET", "/tasks", "")
+	var statuses []bj4.TaskStatus
+	json.Unmarshal(rec.Body.Bytes(), &statuses)
+	if rec.Code != http.StatusOK || len(statuses) != 2 || statuses[0].Name != "a" || statuses[1].Name != "b/c" {
+		t.Error("wrong task list:", rec.Code, rec.Body.String())
+	}
+
+	if rec, _ := serve(t, h, "GET", "/tasks/x", ""); rec.Code != http.StatusNotFound {
+		t.Error("wrong code of a missing task:", rec.Code)
+	}
+
+	if _, status := serve(t, h, "POST", "/tasks/a/pause", ""); !status.Paused {
+		t.Error("task should be paused:", status)
+	}
+	if _, status := serve(t, h, "POST", "/tasks/a/resume", ""); status.Paused {
+		t.Error("task should be resumed:", status)
+	}
+
+	serve(t, h, "POST", "/tasks/a/trigger", "")
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Error("triggered task should run")
+	}
+	sch.WaitIdle()
+	if _, status := serve(t, h, "GET", "/tasks/a", ""); !status.NextUpdate.Equal(later) || status.Disabled {
+		t.Error("triggered run should keep the schedule:", status)
+	}
+
+	at := time.Now().Add(time.Minute).Truncate(time.Second)
+	body, _ := json.Marshal(map[string]time.Time{"at": at})
+	if _, status := serve(t, h, "POST", "/tasks/a/reschedule", string(body)); !status.NextUpdate.Equal(at) {
+		t.Error("task should be rescheduled:", status)
+	}
+	if rec, _ := serve(t, h, "POST", "/tasks/a/reschedule", "{}"); rec.Code != http.StatusBadRequest {
+		t.Error("wrong code of a bad reschedule request:", rec.Code)
+	}
+
+	if rec, _ := serve(t, h, "DELETE", "/tasks/a", ""); rec.Code != http.StatusNoContent {
+		t.Error("wrong code of removing a task:", rec.Code)
+	}
+	if rec, _ := serve(t, h, "GET", "/tasks/a", ""); rec.Code != http.StatusNotFound {
+		t.Error("task should be removed:", rec.Code)
+	}
+}
+
+func TestHandlerNotStarted(t *testing.T) {
+	sch := bj4.New(&bj4.Config{})
+	sch.SetScheduledTask("a", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		return
+	}, time.Now().Add(time.Hour))
+	h := NewHandler(sch)
+
+	for _, path := range []string{"/tasks/a", "/tasks/a/history"} {
+		if rec, _ := serve(t, h, "GET", path, ""); rec.Code != http.StatusServiceUnavailable {
+			t.Error("wrong code before the scheduler starts:", path, rec.Code)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	sch := bj4.New(&bj4.Config{})
+	go sch.Start()
+	defer sch.Stop()
+
+	h := NewHandler(sch, BasicAuth("admin", "secret", "bj4"))
+	req := httptest.NewRequest("GET", "/tasks", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Error("request without credentials should be unauthorized:", rec.Code)
+	}
+	req.SetBasicAuth("admin", "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Error("request with credentials should be authorized:", rec.Code)
+	}
+
+	h = NewHandler(sch, BearerToken("t1", "t2"))
+	for token, code := range map[string]int{"t2": http.StatusOK, "t3": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", "/tasks", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Error("wrong code for token", token, ". expected:", code, ", actual:", rec.Code)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package bj4metrics collects metrics of a bj4 scheduler and its tasks, and
+// exposes them in the Prometheus text format.
+//
+// Metrics is a bj4.Logger which records every run, wrapping another Logger:
+//
+//	m := bj4metrics.New(&bj4.BuiltinLogger{}, nil)
+//	sch := bj4.New(&bj4.Config{Logger: m})
+//	http.Handle("/metrics", m.Handler(sch))
+//
+// The following metrics are exported:
+//
+//	bj4_task_runs_total{task,outcome}        counter of finished runs by outcome:
+//	                                         completed, error, panic, timeout,
+//	                                         retry or skipped
+//	bj4_task_run_duration_seconds{task}      histogram of run durations
+//	bj4_task_schedule_lag_seconds{task}      histogram of the actual start time
+//	                                         minus the time the run was due
+//	bj4_task_misfires_total{task}            counter of missed activations
+//	bj4_tasks{state}                         gauge of tasks by state:
+//	                                         registered, disabled or paused
+//	bj4_next_wakeup_seconds                  gauge of the time until the next
+//	                                         task is due
+package bj4metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of the
+// histograms, covering runs from milliseconds to an hour.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// Options configures Metrics.
+type Options struct {
+	// Buckets are the upper bounds in seconds of the buckets of the
+	// histograms.  The default is DefaultBuckets.
+	Buckets []float64
+	// TaskLabel maps the name of a task to the value of the task label.
+	// Use it to group tasks, e.g. one task per tenant, so that the number
+	// of time series stays bounded.  The default is the name itself.
+	TaskLabel func(name string) string
+}
+
+// Metrics records the runs of tasks.  It implements bj4.Logger, and passes all
+// the calls to the Logger it wraps.
+type Metrics struct {
+	bj4.Logger
+
+	opts Options
+
+	mu       sync.Mutex
+	runs     map[runKey]uint64
+	misfires map[string]uint64
+	duration map[string]*histogram
+	lag      map[string]*histogram
+}
+
+type runKey struct {
+	task    string
+	outcome string
+}
+
+// New creates Metrics wrapping the logger, which can be nil.  opts can be nil
+// for the defaults.
+func New(logger bj4.Logger, opts *Options) *Metrics {
+	if logger == nil {
+		logger = &bj4.NilLogger{}
+	}
+	m := &Metrics{
+		Logger:   logger,
+		runs:     make(map[runKey]uint64),
+		misfires: make(map[string]uint64),
+		duration: make(map[string]*histogram),
+		lag:      make(map[string]*histogram),
+	}
+	if opts != nil {
+		m.opts = *opts
+	}
+	if m.opts.Buckets == nil {
+		m.opts.Buckets = DefaultBuckets
+	}
+	if m.opts.TaskLabel == nil {
+		m.opts.TaskLabel = func(name string) string { return name }
+	}
+	return m
+}
+
+func (m *Metrics) OnTaskStart(task *bj4.Task) {
+	// a triggered run is not due at NextUpdate, and has no lag
+	if !task.Triggered() && !task.NextUpdate.IsZero() {
+		if lag := task.Started.Sub(task.NextUpdate); lag >= 0 {
+			m.mu.Lock()
+			m.histogram(m.lag, task.Name).observe(lag.Seconds())
+			m.mu.Unlock()
+		}
+	}
+	m.Logger.OnTaskStart(task)
+}
+
+func (m *Metrics) OnTaskComplete(task *bj4.Task, result string) {
+	m.finish(task, "completed")
+	m.Logger.OnTaskComplete(task, result)
+}
+
+func (m *Metrics) OnTaskError(task *bj4.Task, err error) {
+	if _, ok := err.(*bj4.PanicError); ok {
+		m.finish(task, "panic")
+	} else {
+		m.finish(task, "error")
+	}
+	m.Logger.OnTaskError(task, err)
+}
+
+func (m *Metrics) OnTaskTimeout(task *bj4.Task) {
+	m.finish(task, "timeout")
+	m.Logger.OnTaskTimeout(task)
+}
+
+func (m *Metrics) OnTaskRetry(task *bj4.Task, err error, delay time.Duration) {
+	m.finish(task, "retry")
+	m.Logger.OnTaskRetry(task, err, delay)
+}
+
+func (m *Metrics) OnTaskSkipped(task *bj4.Task, err error) {
+	m.mu.Lock()
+	m.runs[runKey{m.opts.TaskLabel(task.Name), "skipped"}]++
+	m.mu.Unlock()
+	m.Logger.OnTaskSkipped(task, err)
+}
+
+func (m *Metrics) OnTaskMisfire(task *bj4.Task, missed int) {
+	m.mu.Lock()
+	m.misfires[m.opts.TaskLabel(task.Name)] += uint64(missed)
+	m.mu.Unlock()
+	m.Logger.OnTaskMisfire(task, missed)
+}
+
+// finish records a finished run.
+func (m *Metrics) finish(task *bj4.Task, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	label := m.opts.TaskLabel(task.Name)
+	m.runs[runKey{label, outcome}]++
+	m.histogram(m.duration, task.Name).observe(task.Completed.Sub(task.Started).Seconds())
+}
+
+func (m *Metrics) histogram(hs map[string]*histogram, name string) *histogram {
+	label := m.opts.TaskLabel(name)
+	h, ok := hs[label]
+	if !ok {
+		h = &histogram{bounds: m.opts.Buckets, counts: make([]uint64, len(m.opts.Buckets))}
+		hs[label] = h
+	}
+	return h
+}
+
+// Handler returns a handler serving the metrics of the scheduler, whose Logger
+// is m, in the Prometheus text format.
+func (m *Metrics) Handler(sch *bj4.BJ4) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.Write(w, sch)
+	})
+}
+
+// Write writes the metrics of the scheduler, whose Logger is m, in the
+// Prometheus text format.
+func (m *Metrics) Write(w io.Writer, sch *bj4.BJ4) error {
+	statuses := sch.GetTasks()
+	now := time.Now()
+
+	var b strings.Builder
+	m.mu.Lock()
+	writeHeader(&b, "bj4_task_runs_total", "counter", "Number of finished runs of tasks by outcome.")
+	keys := make([]runKey, 0, len(m.runs))
+	for key := range m.runs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].task != keys[j].task {
+			return keys[i].task < keys[j].task
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "bj4_task_runs_total{task=%s,outcome=%s} %d\n", quote(key.task), quote(key.outcome), m.runs[key])
+	}
+
+	writeHeader(&b, "bj4_task_run_duration_seconds", "histogram", "Duration of runs of tasks.")
+	m.writeHistograms(&b, "bj4_task_run_duration_seconds", m.duration)
+	writeHeader(&b, "bj4_task_schedule_lag_seconds", "histogram", "Actual start time of runs minus the time they were due.")
+	m.writeHistograms(&b, "bj4_task_schedule_lag_seconds", m.lag)
+
+	writeHeader(&b, "bj4_task_misfires_total", "counter", "Number of missed activations of tasks.")
+	for _, label := range sortedKeys(m.misfires) {
+		fmt.Fprintf(&b, "bj4_task_misfires_total{task=%s} %d\n", quote(label), m.misfires[label])
+	}
+	m.mu.Unlock()
+
+	var disabled, paused int
+	var next time.Time
+	for _, status := range statuses {
+		switch {
+		case status.Disabled:
+			disabled++
+		case status.Paused:
+			paused++
+		case next.IsZero() || status.NextUpdate.Before(next):
+			next = status.NextUpdate
+		}
+	}
+	writeHeader(&b, "bj4_tasks", "gauge", "Number of tasks by state.")
+	fmt.Fprintf(&b, "bj4_tasks{state=\"registered\"} %d\n", len(statuses))
+	fmt.Fprintf(&b, "bj4_tasks{state=\"disabled\"} %d\n", disabled)
+	fmt.Fprintf(&b, "bj4_tasks{state=\"paused\"} %d\n", paused)
+	if !next.IsZero() {
+		writeHeader(&b, "bj4_next_wakeup_seconds", "gauge", "Time until the next task is due.")
+		fmt.Fprintf(&b, "bj4_next_wakeup_seconds %s\n", formatFloat(math.Max(next.Sub(now).Seconds(), 0)))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (m *Metrics) writeHistograms(b *strings.Builder, name string, hs map[string]*histogram) {
+	labels := make([]string, 0, len(hs))
+	for label := range hs {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		h := hs[label]
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket{task=%s,le=\"%s\"} %d\n", name, quote(label), formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket{task=%s,le=\"+Inf\"} %d\n", name, quote(label), h.count)
+		fmt.Fprintf(b, "%s_sum{task=%s} %s\n", name, quote(label), formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count{task=%s} %d\n", name, quote(label), h.count)
+	}
+}
+
+// histogram counts observations in buckets.  counts[i] is the number of
+// observations in the i-th bucket only, which are accumulated when written.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	h.sum += v
+	h.count++
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+func writeHeader(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// quote quotes a label value as the text format requires.
+func quote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,119 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New(nil, &Options{Buckets: []float64{0.01, 0.1}})
+	sch := bj4.New(&bj4.Config{Logger: m})
+	go sch.Start()
+	defer sch.Stop()
+
+	<-sch.SetTask("ok", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		time.Sleep(20 * time.Millisecond)
+		return
+	})
+	<-sch.SetTask("fail", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		err = errors.New("oops")
+		return
+	})
+	<-sch.SetTask("panic", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		panic("oops")
+	})
+	sch.SetScheduledTask("later", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		return
+	}, time.Now().Add(time.Hour))
+	sch.PauseTask("later")
+
+	// a triggered run of a disabled task has no lag
+	done, _ := sch.TriggerTask("fail")
+	<-done
+
+	rec := httptest.NewRecorder()
+	m.Handler(sch).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	text := string(body)
+
+	for _, line := range []string{
+		"# TYPE bj4_task_runs_total counter",
+		`bj4_task_runs_total{task="ok",outcome="completed"} 1`,
+		`bj4_task_runs_total{task="fail",outcome="error"} 2`,
+		`bj4_task_runs_total{task="panic",outcome="panic"} 1`,
+		"# TYPE bj4_task_run_duration_seconds histogram",
+		`bj4_task_run_duration_seconds_bucket{task="ok",le="0.01"} 0`,
+		`bj4_task_run_duration_seconds_bucket{task="ok",le="0.1"} 1`,
+		`bj4_task_run_duration_seconds_bucket{task="ok",le="+Inf"} 1`,
+		`bj4_task_run_duration_seconds_count{task="ok"} 1`,
+		`bj4_task_schedule_lag_seconds_count{task="ok"} 1`,
+		`bj4_task_schedule_lag_seconds_count{task="fail"} 1`,
+		`bj4_tasks{state="registered"} 4`,
+		// the panicked task runs again after MinWaitTime
+		`bj4_tasks{state="disabled"} 2`,
+		`bj4_tasks{state="paused"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, text)
+		}
+	}
+}
+
+func TestNextWakeUp(t *testing.T) {
+	m := New(nil, nil)
+	sch := bj4.New(&bj4.Config{Logger: m})
+	go sch.Start()
+	defer sch.Stop()
+
+	sch.SetScheduledTask("1", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		return
+	}, time.Now().Add(time.Minute))
+	sch.WaitIdle()
+
+	var b strings.Builder
+	m.Write(&b, sch)
+	if !strings.Contains(b.String(), "bj4_next_wakeup_seconds 59.9") {
+		t.Error("wrong next wake-up:\n", b.String())
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if s := quote("a\"b\\c\nd"); s != `"a\"b\\c\nd"` {
+		t.Error("wrong quoted value:", s)
+	}
+}
@@ -0,0 +1,148 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package bj4otel traces the runs of bj4 tasks with OpenTelemetry.
+//
+// Middleware creates a span for every run, and passes its context to the task
+// function, so that the spans of the downstream calls of the task are children
+// of the run:
+//
+//	sch := bj4.New(&bj4.Config{
+//		Middlewares: []bj4.TaskMiddleware{bj4otel.Middleware()},
+//	})
+//
+// The span has the following attributes:
+//
+//	bj4.task.name       the name of the task
+//	bj4.task.scheduled  the time the run was due, in RFC 3339
+//	bj4.task.lag        the actual start time minus the time the run was
+//	                    due, in seconds
+//	bj4.task.attempt    the attempt number of the run
+//	bj4.task.outcome    completed, error, panic, timeout or cancelled
+//
+// Errors are recorded as exception events, and panics as "panic" events with
+// the panic value and the stack trace.
+package bj4otel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/rayark/go-bj4/bj4otel"
+
+// SpanName is the name of the span of a run.
+const SpanName = "bj4.task.run"
+
+type options struct {
+	provider trace.TracerProvider
+}
+
+// Option configures Middleware.
+type Option func(opts *options)
+
+// WithTracerProvider sets the TracerProvider creating the spans.  The default
+// is the global TracerProvider.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(opts *options) {
+		opts.provider = provider
+	}
+}
+
+// Middleware returns a bj4.TaskMiddleware which traces every run of a task.
+func Middleware(opts ...Option) bj4.TaskMiddleware {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.provider == nil {
+		o.provider = otel.GetTracerProvider()
+	}
+	tracer := o.provider.Tracer(instrumentationName)
+
+	return func(next bj4.ContextTaskFunction) bj4.ContextTaskFunction {
+		return func(ctx context.Context, task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+			status := task.Snapshot()
+			attrs := []attribute.KeyValue{
+				attribute.String("bj4.task.name", status.Name),
+				attribute.Int("bj4.task.attempt", status.Attempt),
+			}
+			if !status.NextUpdate.IsZero() {
+				attrs = append(attrs,
+					attribute.String("bj4.task.scheduled", status.NextUpdate.Format(time.RFC3339Nano)),
+					attribute.Float64("bj4.task.lag", status.Started.Sub(status.NextUpdate).Seconds()))
+			}
+			ctx, span := tracer.Start(ctx, SpanName,
+				trace.WithTimestamp(status.Started),
+				trace.WithAttributes(attrs...))
+			defer span.End()
+
+			defer func() {
+				if r := recover(); r != nil {
+					span.AddEvent("panic", trace.WithAttributes(
+						attribute.String("bj4.panic.value", fmt.Sprint(r)),
+						attribute.String("bj4.panic.stack", string(debug.Stack()))))
+					span.SetStatus(codes.Error, fmt.Sprintf("panic: %v", r))
+					span.SetAttributes(attribute.String("bj4.task.outcome", "panic"))
+					// let the scheduler handle the panic as its policy says
+					panic(r)
+				}
+			}()
+
+			result, nextUpdate, err = next(ctx, task)
+
+			outcome := "completed"
+			switch {
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				outcome = "timeout"
+			case ctx.Err() != nil:
+				outcome = "cancelled"
+			case err != nil:
+				outcome = "error"
+			}
+			span.SetAttributes(attribute.String("bj4.task.outcome", outcome))
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			} else if outcome != "completed" {
+				span.SetStatus(codes.Error, ctx.Err().Error())
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func attrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestMiddleware(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	sch := bj4.New(&bj4.Config{
+		Middlewares: []bj4.TaskMiddleware{Middleware(WithTracerProvider(provider))},
+	})
+	go sch.Start()
+	defer sch.Stop()
+
+	var spanContext trace.SpanContext
+	<-sch.SetContextTask("ok", func(ctx context.Context, task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		spanContext = trace.SpanContextFromContext(ctx)
+		return
+	})
+	<-sch.SetTask("fail", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		err = errors.New("oops")
+		return
+	})
+	<-sch.SetTask("panic", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		panic("oops")
+	})
+	<-sch.SetContextTask("timeout", func(ctx context.Context, task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		<-ctx.Done()
+		return
+	}, bj4.WithTimeout(10*time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		if span.Name != SpanName {
+			t.Error("wrong span name:", span.Name)
+		}
+		spans[attrs(span)["bj4.task.name"].AsString()] = span
+	}
+	if len(spans) != 4 {
+		t.Fatal("wrong number of spans:", len(spans))
+	}
+
+	ok := spans["ok"]
+	if ok.SpanContext.SpanID() != spanContext.SpanID() {
+		t.Error("task function should receive the context of the span")
+	}
+	a := attrs(ok)
+	if a["bj4.task.outcome"].AsString() != "completed" || a["bj4.task.attempt"].AsInt64() != 1 {
+		t.Error("wrong attributes:", ok.Attributes)
+	}
+	if _, ok := a["bj4.task.scheduled"]; !ok {
+		t.Error("span should have the scheduled time:", ok)
+	}
+	if lag := a["bj4.task.lag"].AsFloat64(); lag < 0 || lag > 0.1 {
+		t.Error("wrong lag:", lag)
+	}
+
+	for name, outcome := range map[string]string{"fail": "error", "panic": "panic", "timeout": "timeout"} {
+		span := spans[name]
+		if attrs(span)["bj4.task.outcome"].AsString() != outcome || span.Status.Code != codes.Error {
+			t.Error("wrong outcome of", name, ":", span.Attributes, span.Status)
+		}
+	}
+	if events := spans["fail"].Events; len(events) != 1 || events[0].Name != "exception" {
+		t.Error("error should be recorded:", events)
+	}
+	var panicked bool
+	for _, event := range spans["panic"].Events {
+		panicked = panicked || event.Name == "panic"
+	}
+	if !panicked {
+		t.Error("panic should be recorded:", spans["panic"].Events)
+	}
+}
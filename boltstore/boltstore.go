@@ -0,0 +1,333 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package boltstore provides a bj4.HistoryStore backed by an embedded bbolt
+// database, for durable scheduling on a single node.
+//
+// The database has three buckets: "tasks" keeps the status of every task,
+// "retries" keeps the retry state of every task, and "history" keeps a nested
+// bucket of run records for every task.  The status, the retry state and the
+// record of a run are updated in a single transaction after every run.
+package boltstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketTasks   = []byte("tasks")
+	bucketRetries = []byte("retries")
+	bucketHistory = []byte("history")
+)
+
+const defaultHistoryLimit = 100
+
+// Options configures the Store.
+type Options struct {
+	// HistoryLimit is the number of run records kept for each task.  Older
+	// records are removed as new ones are saved.  The default is 100.
+	HistoryLimit int
+	// Timeout is how long Open waits for the lock on the database file.
+	// If not set, Open waits forever.
+	Timeout time.Duration
+}
+
+// Store implements bj4.HistoryStore with bbolt.
+type Store struct {
+	path string
+	opts Options
+
+	mu sync.RWMutex
+	db *bolt.DB
+}
+
+type retryState struct {
+	Attempt  int
+	Retrying bool
+}
+
+// Open opens the database at path, creating it if it does not exist.  opts
+// can be nil for the defaults.
+func Open(path string, opts *Options) (*Store, error) {
+	s := &Store{path: path}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.HistoryLimit <= 0 {
+		s.opts.HistoryLimit = defaultHistoryLimit
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) open() error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: s.opts.Timeout})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketTasks, bucketRetries, bucketHistory} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+// Load returns the stored statuses sorted by name, with their retry states.
+func (s *Store) Load() ([]bj4.TaskStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var statuses []bj4.TaskStatus
+	err := s.db.View(func(tx *bolt.Tx) error {
+		retries := tx.Bucket(bucketRetries)
+		return tx.Bucket(bucketTasks).ForEach(func(k, v []byte) error {
+			var status bj4.TaskStatus
+			if err := json.Unmarshal(v, &status); err != nil {
+				return err
+			}
+			if data := retries.Get(k); data != nil {
+				var retry retryState
+				if err := json.Unmarshal(data, &retry); err != nil {
+					return err
+				}
+				status.Attempt = retry.Attempt
+				status.Retrying = retry.Retrying
+			}
+			statuses = append(statuses, status)
+			return nil
+		})
+	})
+	return statuses, err
+}
+
+// Save stores the status and the retry state of a task.
+func (s *Store) Save(status bj4.TaskStatus) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putStatus(tx, status)
+	})
+}
+
+// SaveRun stores the status and the retry state of a task, and appends the
+// record of the run, in a single transaction.
+func (s *Store) SaveRun(status bj4.TaskStatus, record bj4.RunRecord) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := putStatus(tx, status); err != nil {
+			return err
+		}
+
+		history, err := tx.Bucket(bucketHistory).CreateBucketIfNotExists([]byte(status.Name))
+		if err != nil {
+			return err
+		}
+		seq, err := history.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := history.Put(seqKey(seq), data); err != nil {
+			return err
+		}
+		return trimHistory(history, s.opts.HistoryLimit)
+	})
+}
+
+// History returns at most limit records of the latest runs of a task, the
+// latest first.
+func (s *Store) History(name string, limit int) ([]bj4.RunRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var records []bj4.RunRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(bucketHistory).Bucket([]byte(name))
+		if history == nil {
+			return nil
+		}
+		c := history.Cursor()
+		for k, v := c.Last(); k != nil && len(records) < limit; k, v = c.Prev() {
+			var record bj4.RunRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Delete removes the status, the retry state and the history of a task.
+func (s *Store) Delete(name string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := []byte(name)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketTasks).Delete(key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketRetries).Delete(key); err != nil {
+			return err
+		}
+		err := tx.Bucket(bucketHistory).DeleteBucket(key)
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Compact trims the history of every task to the history limit, and rewrites
+// the database file to reclaim the space of deleted data.  Other operations
+// wait until the compaction is done.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		histories := tx.Bucket(bucketHistory)
+		return histories.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			return trimHistory(histories.Bucket(k), s.opts.HistoryLimit)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(dst, s.db, 0)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := s.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		// reopen the original database to stay usable
+		if oerr := s.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	return s.open()
+}
+
+func putStatus(tx *bolt.Tx, status bj4.TaskStatus) error {
+	key := []byte(status.Name)
+
+	retry := retryState{Attempt: status.Attempt, Retrying: status.Retrying}
+	data, err := json.Marshal(retry)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketRetries).Put(key, data); err != nil {
+		return err
+	}
+
+	status.Attempt, status.Retrying = 0, false
+	data, err = json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTasks).Put(key, data)
+}
+
+// trimHistory removes the oldest records until at most limit are left.
+func trimHistory(history *bolt.Bucket, limit int) error {
+	var keys [][]byte
+	c := history.Cursor()
+	n := 0
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		n++
+		if n > limit {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		if err := history.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,185 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package boltstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+func openStore(t *testing.T, path string, opts *Options) *Store {
+	s, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bj4.db")
+	s := openStore(t, path, &Options{HistoryLimit: 3})
+
+	now := time.Now().Truncate(time.Second).UTC()
+	status := bj4.TaskStatus{Name: "1", Status: "retrying: oops", NextUpdate: now, Attempt: 2, Retrying: true}
+	for i := 1; i <= 5; i++ {
+		err := s.SaveRun(status, bj4.RunRecord{Started: now, Finished: now, Attempt: i, Status: "run " + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Save(bj4.TaskStatus{Name: "2", Status: "added"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openStore(t, path, &Options{HistoryLimit: 3})
+	defer s.Close()
+
+	statuses, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bj4.TaskStatus{status, {Name: "2", Status: "added"}}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Error("wrong statuses. expected:", expected, ", actual:", statuses)
+	}
+
+	records, err := s.History("1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seq []string
+	for _, record := range records {
+		seq = append(seq, record.Status)
+	}
+	if !reflect.DeepEqual(seq, []string{"run 5", "run 4", "run 3"}) {
+		t.Error("wrong history:", seq)
+	}
+
+	if err := s.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("3"); err != nil {
+		t.Fatal(err)
+	}
+	statuses, _ = s.Load()
+	records, _ = s.History("1", 10)
+	if len(statuses) != 1 || len(records) != 0 {
+		t.Error("task is not deleted:", statuses, records)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bj4.db")
+	s := openStore(t, path, &Options{HistoryLimit: 1000})
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		status := bj4.TaskStatus{Name: strconv.Itoa(i % 10), Status: "completed: " + strconv.Itoa(i)}
+		if err := s.SaveRun(status, bj4.RunRecord{Attempt: 1, Status: status.Status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 9; i++ {
+		s.Delete(strconv.Itoa(i))
+	}
+
+	before, _ := os.Stat(path)
+	s.opts.HistoryLimit = 10
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Error("database is not compacted:", before.Size(), "->", after.Size())
+	}
+
+	records, err := s.History("9", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 10 || records[0].Status != "completed: 999" {
+		t.Error("wrong history after compaction:", len(records), records)
+	}
+}
+
+func TestRecoverInterruptedRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bj4.db")
+	s := openStore(t, path, nil)
+	defer s.Close()
+
+	// as if the process crashed while running the second attempt
+	started := time.Now().Add(-time.Minute)
+	s.Save(bj4.TaskStatus{
+		Name:       "1",
+		Status:     "running",
+		NextUpdate: started,
+		Started:    started,
+		Attempt:    2,
+		Retrying:   true,
+	})
+
+	var attempts []int
+	sch := bj4.New(&bj4.Config{Store: s})
+	go sch.Start()
+	errChan := sch.Register("1", func(ctx context.Context, task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		attempts = append(attempts, task.Attempt)
+		nextUpdate = time.Now().Add(time.Hour)
+		return
+	}, bj4.WithRetry(bj4.RetryPolicy{MaxAttempts: 3}))
+
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	sch.Stop()
+
+	if !reflect.DeepEqual(attempts, []int{2}) {
+		t.Error("interrupted attempt is not run again:", attempts)
+	}
+
+	records, err := s.History("1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Status != "interrupted" || records[0].Status != "completed: " {
+		t.Error("wrong history:", records)
+	}
+	statuses, _ := s.Load()
+	if len(statuses) != 1 || statuses[0].Retrying || statuses[0].Attempt != 2 {
+		t.Error("wrong status:", statuses)
+	}
+}
@@ -0,0 +1,145 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the scheduler.  All the times of the
+// scheduler and its tasks, and the timers waking the scheduler up, come from
+// the Clock, so that tests can control the time with a FakeClock.  Elector and
+// Locker implementations keep their own time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a Timer which sends the current time on its channel
+	// after d.
+	NewTimer(d time.Duration) Timer
+	// AfterFunc creates a Timer which calls f on its own goroutine after d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock.  It behaves like time.Timer.
+type Timer interface {
+	// C returns the channel the time is sent on when the timer fires.  It
+	// is nil for timers created by AfterFunc.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing.  Returns false if the timer has
+	// fired or been stopped already.
+	Stop() bool
+	// Reset changes the timer to fire after d.  Returns false if the timer
+	// had fired or been stopped.
+	Reset(d time.Duration) bool
+}
+
+// RealClock is the Clock of the real time, which is the default.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// withTimeout is context.WithTimeout on the clock.
+func withTimeout(parent context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(RealClock); ok {
+		return context.WithTimeout(parent, d)
+	}
+	ctx := &timeoutContext{
+		Context:  parent,
+		deadline: clock.Now().Add(d),
+		done:     make(chan struct{}),
+	}
+	stop := context.AfterFunc(parent, func() {
+		ctx.cancel(parent.Err())
+	})
+	timer := clock.AfterFunc(d, func() {
+		ctx.cancel(context.DeadlineExceeded)
+	})
+	return ctx, func() {
+		stop()
+		timer.Stop()
+		ctx.cancel(context.Canceled)
+	}
+}
+
+// timeoutContext is a context cancelled by a timer of a Clock other than
+// RealClock.  It has its own done channel rather than embedding the one of
+// context.WithCancel, so that the contexts derived from it get
+// context.DeadlineExceeded as well once the timer fires.
+type timeoutContext struct {
+	context.Context
+	deadline time.Time
+	done     chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (ctx *timeoutContext) Deadline() (time.Time, bool) {
+	return ctx.deadline, true
+}
+
+func (ctx *timeoutContext) Done() <-chan struct{} {
+	return ctx.done
+}
+
+func (ctx *timeoutContext) Err() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.err
+}
+
+func (ctx *timeoutContext) cancel(err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.err == nil {
+		ctx.err = err
+		close(ctx.done)
+	}
+}
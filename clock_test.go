@@ -0,0 +1,177 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	t1 := clock.NewTimer(2 * time.Second)
+	t2 := clock.NewTimer(time.Second)
+	fired := make(chan struct{})
+	clock.AfterFunc(3*time.Second, func() {
+		close(fired)
+	})
+
+	clock.Advance(time.Second)
+	select {
+	case now := <-t2.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Error("wrong time fired:", now)
+		}
+	default:
+		t.Error("timer should fire")
+	}
+	select {
+	case <-t1.C():
+		t.Error("timer should not fire before its time")
+	default:
+	}
+
+	if !t1.Stop() {
+		t.Error("stopping an active timer should return true")
+	}
+	if t1.Reset(time.Second) {
+		t.Error("resetting a stopped timer should return false")
+	}
+	clock.Set(start.Add(3 * time.Second))
+	select {
+	case <-t1.C():
+	default:
+		t.Error("reset timer should fire")
+	}
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Error("function should be called")
+	}
+	if !clock.Now().Equal(start.Add(3 * time.Second)) {
+		t.Error("wrong time:", clock.Now())
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	fired := make(chan struct{})
+	go func() {
+		<-clock.NewTimer(time.Second).C()
+		close(fired)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer set before BlockUntil returns should fire")
+	}
+}
+
+func TestFakeClockScheduler(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	var runs []time.Time
+	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		runs = append(runs, clock.Now())
+		nextUpdate = clock.Now().Add(time.Hour)
+		return
+	}, clock.Now().Add(time.Hour))
+
+	sch.WaitIdle()
+	if len(runs) != 0 {
+		t.Fatal("task should not run before it is due:", runs)
+	}
+	clock.Advance(time.Hour)
+	sch.WaitIdle()
+	clock.Advance(30 * time.Minute)
+	sch.WaitIdle()
+	clock.Advance(30 * time.Minute)
+	sch.WaitIdle()
+	if len(runs) != 2 || runs[1].Sub(runs[0]) != time.Hour {
+		t.Error("task should run every hour:", runs)
+	}
+
+	status, _ := sch.GetTask("1")
+	if !status.Started.Equal(runs[1]) || !status.Completed.Equal(runs[1]) || !status.NextUpdate.Equal(runs[1].Add(time.Hour)) {
+		t.Error("times of the task should come from the clock:", status)
+	}
+}
+
+func TestFakeClockTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan struct{})
+	ctxErr := make(chan error, 1)
+	errChan := sch.SetContextTask("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		<-ctx.Done()
+		ctxErr <- ctx.Err()
+		return
+	}, WithTimeout(time.Minute))
+
+	// the timer of the timeout is set once the task runs
+	<-started
+	clock.Advance(59 * time.Second)
+	select {
+	case <-errChan:
+		t.Fatal("task should not time out before its timeout")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-errChan:
+		if err != ErrTaskTimeout {
+			t.Error("wrong error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("task should time out")
+	}
+	if err := <-ctxErr; err != context.DeadlineExceeded {
+		t.Error("wrong context error:", err)
+	}
+	sch.WaitIdle()
+	if status, _ := sch.GetTask("1"); !strings.HasPrefix(status.Status, "timeout: ") {
+		t.Error("wrong status:", status.Status)
+	}
+}
@@ -0,0 +1,146 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the content of the job file.
+type config struct {
+	Jobs []job `yaml:"jobs"`
+}
+
+// job describes a command run on a schedule.
+type job struct {
+	Name     string            `yaml:"name"`
+	Schedule string            `yaml:"schedule"`
+	Command  string            `yaml:"command"`
+	Args     []string          `yaml:"args"`
+	Env      map[string]string `yaml:"env"`
+	Dir      string            `yaml:"dir"`
+	Timeout  duration          `yaml:"timeout"`
+	Retry    *retry            `yaml:"retry"`
+}
+
+// retry describes the retry policy of a job.  See bj4.RetryPolicy.
+type retry struct {
+	MaxAttempts  int      `yaml:"max_attempts"`
+	InitialDelay duration `yaml:"initial_delay"`
+	Multiplier   float64  `yaml:"multiplier"`
+	MaxDelay     duration `yaml:"max_delay"`
+	// Jitter is "none", "full" or "equal".
+	Jitter string `yaml:"jitter"`
+}
+
+// duration is a time.Duration written as a string such as "1m30s" in YAML.
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", value.Line, err)
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads and validates the job file at path.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	names := make(map[string]bool)
+	for _, j := range cfg.Jobs {
+		if j.Name == "" {
+			return nil, fmt.Errorf("%s: job without name", path)
+		}
+		if names[j.Name] {
+			return nil, fmt.Errorf("%s: duplicate job %q", path, j.Name)
+		}
+		names[j.Name] = true
+		if j.Command == "" {
+			return nil, fmt.Errorf("%s: job %q: no command", path, j.Name)
+		}
+		schedule, err := bj4.ParseSchedule(j.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: job %q: %v", path, j.Name, err)
+		}
+		if schedule.Next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("%s: job %q: %v", path, j.Name, bj4.ErrNoActivation)
+		}
+		if _, err := j.Retry.policy(); err != nil {
+			return nil, fmt.Errorf("%s: job %q: %v", path, j.Name, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// policy converts the retry policy, or returns nil if there is none.
+func (r *retry) policy() (*bj4.RetryPolicy, error) {
+	if r == nil {
+		return nil, nil
+	}
+	policy := &bj4.RetryPolicy{
+		MaxAttempts:  r.MaxAttempts,
+		InitialDelay: time.Duration(r.InitialDelay),
+		Multiplier:   r.Multiplier,
+		MaxDelay:     time.Duration(r.MaxDelay),
+	}
+	switch r.Jitter {
+	case "", "none":
+		policy.Jitter = bj4.NoJitter
+	case "full":
+		policy.Jitter = bj4.FullJitter
+	case "equal":
+		policy.Jitter = bj4.EqualJitter
+	default:
+		return nil, fmt.Errorf("unknown jitter %q", r.Jitter)
+	}
+	return policy, nil
+}
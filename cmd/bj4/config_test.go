@@ -0,0 +1,105 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "bj4.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+jobs:
+  - name: backup
+    schedule: "0 3 * * *"
+    command: /bin/echo
+    args: [a, b]
+    env:
+      X: "1"
+    dir: /tmp
+    timeout: 1m30s
+    retry:
+      max_attempts: 3
+      initial_delay: 1s
+      jitter: full
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Jobs) != 1 {
+		t.Fatal("wrong number of jobs:", len(cfg.Jobs))
+	}
+	j := cfg.Jobs[0]
+	if j.Name != "backup" || j.Command != "/bin/echo" || len(j.Args) != 2 || j.Env["X"] != "1" || j.Dir != "/tmp" {
+		t.Error("wrong job:", j)
+	}
+	if time.Duration(j.Timeout) != 90*time.Second {
+		t.Error("wrong timeout:", time.Duration(j.Timeout))
+	}
+	policy, err := j.Retry.policy()
+	if err != nil || policy.MaxAttempts != 3 || policy.InitialDelay != time.Second || policy.Jitter != bj4.FullJitter {
+		t.Error("wrong retry policy:", policy, err)
+	}
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	for _, c := range []struct {
+		content string
+		err     string
+	}{
+		{"jobs:\n  - schedule: '@daily'\n    command: x\n", "without name"},
+		{"jobs:\n  - name: a\n    schedule: '@daily'\n", "no command"},
+		{"jobs:\n  - name: a\n    schedule: '* *'\n    command: x\n", "invalid cron spec"},
+		{"jobs:\n  - name: a\n    schedule: '0 0 30 2 *'\n    command: x\n", "no next activation"},
+		{"jobs:\n  - name: a\n    schedule: '@daily'\n    command: x\n  - name: a\n    schedule: '@daily'\n    command: x\n", "duplicate"},
+		{"jobs:\n  - name: a\n    schedule: '@daily'\n    command: x\n    timeout: soon\n", "duration"},
+		{"jobs:\n  - name: a\n    schedule: '@daily'\n    command: x\n    retry: {jitter: half}\n", "jitter"},
+		{"jobs:\n  - name: a\n    schedule: '@daily'\n    command: x\n    cmd: y\n", "cmd"},
+	} {
+		_, err := loadConfig(writeConfig(t, c.content))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error containing %q, actual: %v", c.err, err)
+		}
+	}
+}
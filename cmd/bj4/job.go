@@ -0,0 +1,135 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+// maxOutput is the number of bytes of the output of a command kept in the
+// result of its task.  The earlier output is dropped.
+const maxOutput = 4096
+
+// function returns the task function running the command of the job.  The
+// combined stdout and stderr of the command is the result of the task, or is
+// a part of the error if the command fails.
+func (j *job) function() bj4.ContextTaskFunction {
+	return func(ctx context.Context, task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		cmd := exec.CommandContext(ctx, j.Command, j.Args...)
+		cmd.Dir = j.Dir
+		cmd.Env = j.environ()
+		out := &tailBuffer{limit: maxOutput}
+		cmd.Stdout = out
+		cmd.Stderr = out
+
+		err = cmd.Run()
+		result = out.String()
+		if err != nil {
+			if result != "" {
+				err = fmt.Errorf("%v: %s", err, result)
+			}
+			return "", time.Time{}, err
+		}
+		return result, time.Time{}, nil
+	}
+}
+
+// options returns the options of the task running the job.
+func (j *job) options() []bj4.TaskOption {
+	var opts []bj4.TaskOption
+	if j.Timeout > 0 {
+		opts = append(opts, bj4.WithTimeout(time.Duration(j.Timeout)))
+	}
+	if policy, _ := j.Retry.policy(); policy != nil {
+		opts = append(opts, bj4.WithRetry(*policy))
+	}
+	return opts
+}
+
+// environ returns the environment of the process with the variables of the
+// job added.
+func (j *job) environ() []string {
+	if len(j.Env) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(j.Env))
+	for k := range j.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := os.Environ()
+	for _, k := range keys {
+		env = append(env, k+"="+j.Env[k])
+	}
+	return env
+}
+
+// tailBuffer keeps the last limit bytes written to it.  It is safe for the
+// stdout and the stderr of a command to write to it concurrently.
+type tailBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	b.buf.Write(p)
+	if extra := b.buf.Len() - b.limit; extra > 0 {
+		b.buf.Next(extra)
+		b.truncated = true
+	}
+	return n, nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := strings.TrimSpace(b.buf.String())
+	if b.truncated {
+		s = "..." + s
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestJobFunction(t *testing.T) {
+	j := &job{
+		Command: "sh",
+		Args:    []string{"-c", `echo "$GREETING" in $(pwd); echo oops >&2`},
+		Env:     map[string]string{"GREETING": "hello"},
+		Dir:     "/",
+	}
+	result, _, err := j.function()(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "hello in /\noops" {
+		t.Errorf("wrong result: %q", result)
+	}
+
+	j = &job{Command: "sh", Args: []string{"-c", "echo failed; exit 3"}}
+	if _, _, err := j.function()(context.Background(), nil); err == nil || err.Error() != "exit status 3: failed" {
+		t.Error("wrong error:", err)
+	}
+
+	// the command is killed when the context is cancelled
+	j = &job{Command: "sleep", Args: []string{"10"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s := time.Now()
+	if _, _, err := j.function()(ctx, nil); err == nil {
+		t.Error("killed command should fail")
+	}
+	if d := time.Since(s); d > time.Second {
+		t.Error("command should be killed. took:", d)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{limit: 8}
+	b.Write([]byte("0123"))
+	if s := b.String(); s != "0123" {
+		t.Errorf("wrong content: %q", s)
+	}
+	b.Write([]byte("456789"))
+	if s := b.String(); s != "...23456789" {
+		t.Errorf("wrong content: %q", s)
+	}
+	if s := (&tailBuffer{limit: 8}).String(); s != "" {
+		t.Errorf("wrong content: %q", s)
+	}
+}
@@ -0,0 +1,155 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Command bj4 runs the commands described in a job file on their schedules,
+// as a replacement of crontab.
+//
+// The job file is in YAML:
+//
+//	jobs:
+//	  - name: backup
+//	    schedule: "0 3 * * *"
+//	    command: /usr/local/bin/backup
+//	    args: ["--full"]
+//	    env:
+//	      BACKUP_DIR: /var/backups
+//	    dir: /tmp
+//	    timeout: 1h
+//	    retry:
+//	      max_attempts: 3
+//	      initial_delay: 1m
+//	      multiplier: 2
+//	      max_delay: 10m
+//	      jitter: full
+//
+// The schedule is a cron spec accepted by bj4.ParseSchedule.  The combined
+// stdout and stderr of a command, up to its last 4096 bytes, is the result of
+// the task, or is a part of the error if the command exits with a non-zero
+// status.
+//
+// The job file is reloaded on SIGHUP.  Added jobs are scheduled, removed jobs
+// are removed, and changed jobs are rescheduled, while unchanged jobs keep
+// their schedules.  If the file cannot be loaded, the running jobs are kept.
+// bj4 stops on SIGINT or SIGTERM, after the running commands are killed.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	bj4 "github.com/rayark/go-bj4"
+	"github.com/rayark/go-bj4/bj4http"
+)
+
+func main() {
+	path := flag.String("config", "bj4.yaml", "path of the job file")
+	addr := flag.String("http", "", "address to serve the dashboard and the API at, e.g. localhost:8080")
+	flag.Parse()
+
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sch := bj4.New(&bj4.Config{Logger: &bj4.BuiltinLogger{}})
+	r := &runner{sch: sch}
+	r.apply(cfg)
+
+	if *addr != "" {
+		mux := http.NewServeMux()
+		bj4http.Mount(mux, "/bj4", sch)
+		go func() {
+			log.Fatal(http.ListenAndServe(*addr, mux))
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				sch.Stop()
+				return
+			}
+			cfg, err := loadConfig(*path)
+			if err != nil {
+				log.Println("keeping the running jobs:", err)
+				continue
+			}
+			r.apply(cfg)
+			log.Printf("reloaded %d jobs from %s\n", len(cfg.Jobs), *path)
+		}
+	}()
+
+	if err := sch.Start(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runner keeps the tasks of the scheduler in sync with the job file.
+type runner struct {
+	sch  *bj4.BJ4
+	jobs map[string]job
+}
+
+// apply adds the tasks of the added and the changed jobs, and removes the
+// tasks of the removed jobs.
+func (r *runner) apply(cfg *config) {
+	jobs := make(map[string]job, len(cfg.Jobs))
+	for _, j := range cfg.Jobs {
+		jobs[j.Name] = j
+	}
+
+	for name := range r.jobs {
+		if _, ok := jobs[name]; !ok {
+			r.sch.RemoveTask(name)
+		}
+	}
+	for _, j := range cfg.Jobs {
+		if old, ok := r.jobs[j.Name]; ok && reflect.DeepEqual(old, j) {
+			continue
+		}
+		j := j
+		if _, err := r.sch.SetCronContextTask(j.Name, j.Schedule, j.function(), j.options()...); err != nil {
+			// the task of the job, if any, is left as it is
+			log.Printf("job %q: %v\n", j.Name, err)
+			if old, ok := r.jobs[j.Name]; ok {
+				jobs[j.Name] = old
+			} else {
+				delete(jobs, j.Name)
+			}
+		}
+	}
+	r.jobs = jobs
+}
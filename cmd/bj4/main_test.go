@@ -0,0 +1,90 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+func TestRunnerApply(t *testing.T) {
+	sch := bj4.New(&bj4.Config{})
+	go sch.Start()
+	defer sch.Stop()
+
+	r := &runner{sch: sch}
+	r.apply(&config{Jobs: []job{
+		{Name: "a", Schedule: "@hourly", Command: "true"},
+		{Name: "b", Schedule: "@hourly", Command: "true"},
+	}})
+	sch.WaitIdle()
+	a, err := sch.GetTask("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch.RescheduleTask("a", a.NextUpdate.Add(time.Minute))
+
+	// a is unchanged, b is removed, c is added
+	r.apply(&config{Jobs: []job{
+		{Name: "a", Schedule: "@hourly", Command: "true"},
+		{Name: "c", Schedule: "@daily", Command: "true"},
+	}})
+	if status, _ := sch.GetTask("a"); !status.NextUpdate.Equal(a.NextUpdate.Add(time.Minute)) {
+		t.Error("unchanged job should keep its schedule:", status)
+	}
+	if _, err := sch.GetTask("b"); err != bj4.ErrTaskNotFound {
+		t.Error("removed job should be removed:", err)
+	}
+	if _, err := sch.GetTask("c"); err != nil {
+		t.Error("added job should be added:", err)
+	}
+
+	// a is changed
+	r.apply(&config{Jobs: []job{
+		{Name: "a", Schedule: "@daily", Command: "true"},
+	}})
+	if status, _ := sch.GetTask("a"); status.NextUpdate.Equal(a.NextUpdate.Add(time.Minute)) {
+		t.Error("changed job should be rescheduled:", status)
+	}
+
+	// d never activates, and is not added
+	r.apply(&config{Jobs: []job{
+		{Name: "a", Schedule: "@daily", Command: "true"},
+		{Name: "d", Schedule: "0 0 30 2 *", Command: "true"},
+	}})
+	if _, err := sch.GetTask("d"); err != bj4.ErrTaskNotFound {
+		t.Error("job without activation should not be added:", err)
+	}
+	if _, ok := r.jobs["d"]; ok {
+		t.Error("job without activation should not be kept")
+	}
+}
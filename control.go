@@ -0,0 +1,319 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTaskNotFound is returned by the operations on a task which does not exist.
+var ErrTaskNotFound = errors.New("bj4 task not found")
+
+// do runs fn on the goroutine running Start, and returns its error.  If the
+// scheduler has not been started, do blocks until it starts.
+// Returns ErrNotStarted if the scheduler is stopped, in which case fn never
+// runs, even if the scheduler restarts.
+func (bj4 *BJ4) do(fn func() error) error {
+	bj4.mu.Lock()
+	quit := bj4.quit
+	bj4.mu.Unlock()
+	select {
+	case <-quit:
+		return ErrNotStarted
+	default:
+	}
+
+	// either the loop claims the operation and runs fn, or the caller
+	// claims it on stop, so that a queued operation is not run by the next
+	// loop after the caller has returned
+	var claimed atomic.Bool
+	errChan := make(chan error, 1)
+	op := func() {
+		if claimed.CompareAndSwap(false, true) {
+			errChan <- fn()
+		}
+	}
+	bj4.enqueue(op)
+	select {
+	case err := <-errChan:
+		return err
+	case <-quit:
+		if claimed.CompareAndSwap(false, true) {
+			return ErrNotStarted
+		}
+		return <-errChan
+	}
+}
+
+// doTask runs fn with the task of the name on the goroutine running Start.
+// Returns ErrTaskNotFound if there is no such task.
+func (bj4 *BJ4) doTask(name string, fn func(task *Task)) error {
+	return bj4.do(func() error {
+		task, ok := bj4.tasks[name]
+		if !ok {
+			return ErrTaskNotFound
+		}
+		fn(task)
+		return nil
+	})
+}
+
+// readTask is doTask for reading the task, which does not block until the
+// scheduler starts.  Returns ErrNotStarted if the scheduler is not running.
+func (bj4 *BJ4) readTask(name string, fn func(task *Task)) error {
+	bj4.mu.Lock()
+	started := bj4.state == stateStarted
+	bj4.mu.Unlock()
+	if !started {
+		return ErrNotStarted
+	}
+	return bj4.doTask(name, fn)
+}
+
+// GetTask gets the status of the task of the name.  Returns ErrNotStarted if
+// the scheduler is not running.
+func (bj4 *BJ4) GetTask(name string) (status TaskStatus, err error) {
+	err = bj4.readTask(name, func(task *Task) {
+		status = bj4.status(task)
+	})
+	return
+}
+
+// GetHistory gets the records of the latest runs of the task of the name, the
+// latest first.  At most HistoryLimit in Config records are kept in memory.
+// Returns ErrNotStarted if the scheduler is not running.
+func (bj4 *BJ4) GetHistory(name string) (records []RunRecord, err error) {
+	err = bj4.readTask(name, func(task *Task) {
+		records = make([]RunRecord, len(task.history))
+		for i, record := range task.history {
+			records[len(records)-1-i] = record
+		}
+	})
+	return
+}
+
+// WaitIdle blocks until the scheduler is idle, which is when no task is
+// running or due, and no operation such as SetTask is pending.  It is meant
+// for tests: after moving a FakeClock, WaitIdle returns once the tasks due are
+// done.  Returns ErrNotStarted if the scheduler is stopped.
+func (bj4 *BJ4) WaitIdle() error {
+	idle := make(chan struct{})
+	err := bj4.do(func() error {
+		bj4.idleWaiters = append(bj4.idleWaiters, idle)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bj4.mu.Lock()
+	quit := bj4.quit
+	bj4.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-quit:
+		return ErrNotStarted
+	}
+}
+
+// PauseTask stops the task from running on its schedule until ResumeTask is
+// called.  A running task is not interrupted.  The activations which fall due
+// while the task is paused are not run at the time; see ResumeTask.  The
+// paused state is kept in the Store, if there is one.
+func (bj4 *BJ4) PauseTask(name string) error {
+	return bj4.doTask(name, func(task *Task) {
+		task.mu.Lock()
+		task.Paused = true
+		task.mu.Unlock()
+		bj4.queue.remove(task)
+		bj4.saveTask(task)
+	})
+}
+
+// ResumeTask resumes a task paused by PauseTask, and enables it if it is
+// disabled.  If the task became due while paused, it is overdue, and runs as
+// its misfire policy says: once with MisfireFireOnce, once for every missed
+// activation with MisfireCatchUp, and not until its next activation with
+// MisfireSkip.  A task without a schedule runs once.  A disabled task is due at
+// the next activation of its schedule, or at once if it has no schedule.
+func (bj4 *BJ4) ResumeTask(name string) error {
+	return bj4.doTask(name, func(task *Task) {
+		task.mu.Lock()
+		task.Paused = false
+		task.mu.Unlock()
+		if bj4.isRunning(name) {
+			bj4.saveTask(task)
+			return
+		}
+		if task.Disabled {
+			next := bj4.clock.Now()
+			if task.schedule != nil {
+				next = task.schedule.Next(next)
+			}
+			if !next.IsZero() {
+				task.rescheduleTo(next)
+			}
+		}
+		bj4.saveTask(task)
+		bj4.queue.schedule(task, bj4.taskTTL)
+	})
+}
+
+// PauseAll stops the scheduler from starting any task, including the
+// triggered ones, until ResumeAll is called, e.g. during a maintenance.  The
+// running tasks are not interrupted.  While the scheduler is paused, Paused in
+// TaskStatus is true for every task.  Once resumed, the tasks which became due
+// while paused run as their misfire policies say, like in ResumeTask.  Unlike
+// PauseTask, the pause is not kept in the Store, and ends once the scheduler
+// is stopped.
+func (bj4 *BJ4) PauseAll() error {
+	return bj4.do(func() error {
+		bj4.paused = true
+		return nil
+	})
+}
+
+// ResumeAll resumes the scheduler paused by PauseAll.  The tasks paused by
+// PauseTask stay paused.
+func (bj4 *BJ4) ResumeAll() error {
+	return bj4.do(func() error {
+		bj4.paused = false
+		return nil
+	})
+}
+
+// status returns the status of the task, paused if the scheduler is.
+func (bj4 *BJ4) status(task *Task) TaskStatus {
+	status := task.Snapshot()
+	status.Paused = status.Paused || bj4.paused
+	return status
+}
+
+// TriggerTask runs the task as soon as possible, even if it is paused or
+// disabled.  The triggered run does not change the schedule of the task: after
+// it, the task is due at the time it was due before, unless the run is retried.
+// If the task is running, it runs again once the current run is done.
+//
+// The returned channel receives the error the triggered run finishes with,
+// after its retries, or nil if it succeeds.  Unlike the channel returned by
+// SetTask, it is not shared with other runs.  See waitRun for the other errors
+// it may receive.
+func (bj4 *BJ4) TriggerTask(name string) (<-chan error, error) {
+	var ch <-chan error
+	err := bj4.doTask(name, func(task *Task) {
+		task.trigger = bj4.clock.Now()
+		ch = task.waitRun(true)
+		if !bj4.isRunning(name) {
+			bj4.queue.schedule(task, bj4.taskTTL)
+		}
+	})
+	return ch, err
+}
+
+// RescheduleTask moves the next update time of the task to at, and enables it
+// if it is disabled.  A pending retry is abandoned.  If the task is running,
+// it is rescheduled once the current run is done.
+//
+// The returned channel receives the error the next scheduled run, normally the
+// one at at, finishes with, after its retries, or nil if it succeeds.  The
+// triggered runs before it are not waited for.  See waitRun for the other
+// errors it may receive.
+func (bj4 *BJ4) RescheduleTask(name string, at time.Time) (<-chan error, error) {
+	var ch <-chan error
+	err := bj4.doTask(name, func(task *Task) {
+		ch = task.waitRun(false)
+		if bj4.isRunning(name) {
+			task.reschedule = at
+			return
+		}
+		task.rescheduleTo(at)
+		bj4.saveTask(task)
+		bj4.queue.schedule(task, bj4.taskTTL)
+	})
+	return ch, err
+}
+
+// runWaiter is the channel waiting for the next triggered or scheduled run of
+// a task.
+type runWaiter struct {
+	ch        chan error
+	triggered bool
+}
+
+// waitRun returns the channel receiving the outcome of the next triggered or
+// the next scheduled run of the task.  Besides the error of the run, it
+// receives ErrLockHeld if the run is skipped because it is done elsewhere,
+// ErrTaskAbandoned if the run is abandoned by Shutdown, and ErrTaskNotFound if
+// the task is removed or replaced before the run starts.
+func (task *Task) waitRun(triggered bool) <-chan error {
+	ch := make(chan error, 1)
+	task.waiters = append(task.waiters, runWaiter{ch: ch, triggered: triggered})
+	return ch
+}
+
+// takeWaiters moves the waiters of the run starting to runWaiters.
+func (task *Task) takeWaiters() {
+	waiters := task.waiters[:0]
+	for _, w := range task.waiters {
+		if w.triggered == task.triggered {
+			task.runWaiters = append(task.runWaiters, w.ch)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	task.waiters = waiters
+}
+
+// notifyWaiters sends err to the waiters of the run done.
+func (task *Task) notifyWaiters(err error) {
+	for _, ch := range task.runWaiters {
+		ch <- err
+	}
+	task.runWaiters = nil
+}
+
+// dropWaiters sends ErrTaskNotFound to the waiters of the runs not started,
+// once the task is removed or replaced.
+func (task *Task) dropWaiters() {
+	for _, w := range task.waiters {
+		w.ch <- ErrTaskNotFound
+	}
+	task.waiters = nil
+}
+
+func (task *Task) rescheduleTo(at time.Time) {
+	task.NextUpdate = at
+	task.Disabled = false
+	task.Retrying = false
+	task.reschedule = time.Time{}
+}
@@ -0,0 +1,324 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPauseAndResumeTask(t *testing.T) {
+	var runs int32
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		atomic.AddInt32(&runs, 1)
+		return
+	}, start.Add(50*time.Millisecond))
+
+	if err := sch.PauseTask("1"); err != nil {
+		t.Fatal(err)
+	}
+	sch.WaitIdle()
+	clock.Advance(100 * time.Millisecond)
+	sch.WaitIdle()
+	if n := atomic.LoadInt32(&runs); n != 0 {
+		t.Error("paused task should not run. actual runs:", n)
+	}
+	if status, _ := sch.GetTask("1"); !status.Paused {
+		t.Error("task should be paused:", status)
+	}
+
+	// the task is overdue, and runs once resumed
+	if err := sch.ResumeTask("1"); err != nil {
+		t.Fatal(err)
+	}
+	sch.WaitIdle()
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Error("resumed task should run. actual runs:", n)
+	}
+
+	if err := sch.PauseTask("2"); err != ErrTaskNotFound {
+		t.Error("wrong error of a missing task:", err)
+	}
+}
+
+func TestStoppedOperation(t *testing.T) {
+	sch := New(&Config{})
+	go sch.Start()
+	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		return
+	}, time.Now().Add(time.Hour))
+	sch.WaitIdle()
+	if _, err := sch.GetTask("1"); err != nil {
+		t.Fatal(err)
+	}
+	sch.Stop()
+
+	// the operations on the stopped scheduler are not applied on restart
+	for i := 0; i < 32; i++ {
+		if err := sch.PauseTask("1"); err != ErrNotStarted {
+			t.Fatal("expected ErrNotStarted, actual:", err)
+		}
+	}
+	go sch.Start()
+	defer sch.Stop()
+	status, err := sch.GetTask("1")
+	for err == ErrNotStarted {
+		time.Sleep(time.Millisecond)
+		status, err = sch.GetTask("1")
+	}
+	if err != nil || status.Paused {
+		t.Error("task should not be paused:", status, err)
+	}
+}
+
+func TestGetTaskBeforeStart(t *testing.T) {
+	sch := New(&Config{})
+	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		return
+	}, time.Now().Add(time.Hour))
+
+	// reading a task does not wait for the scheduler to start
+	if _, err := sch.GetTask("1"); err != ErrNotStarted {
+		t.Error("expected ErrNotStarted, actual:", err)
+	}
+	if _, err := sch.GetHistory("1"); err != ErrNotStarted {
+		t.Error("expected ErrNotStarted, actual:", err)
+	}
+
+	go sch.Start()
+	defer sch.Stop()
+	sch.WaitIdle()
+	if _, err := sch.GetTask("1"); err != nil {
+		t.Error("task should be added on start:", err)
+	}
+}
+
+func TestTriggerAndRescheduleTask(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	later := start.Add(time.Hour)
+	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		return
+	}, later)
+
+	done, err := sch.TriggerTask("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Error("triggered run failed:", err)
+	}
+	status, _ := sch.GetTask("1")
+	if !status.NextUpdate.Equal(later) || status.Disabled || !status.Completed.Equal(start) {
+		t.Error("triggered run should keep the schedule:", status)
+	}
+
+	done, err = sch.RescheduleTask("1", start.Add(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch.WaitIdle()
+	clock.Advance(50*time.Millisecond - 1)
+	sch.WaitIdle()
+	select {
+	case <-done:
+		t.Fatal("rescheduled task should not run before its time")
+	default:
+	}
+	clock.Advance(1)
+	<-done
+	if status, _ := sch.GetTask("1"); !status.Completed.Equal(start.Add(50 * time.Millisecond)) {
+		t.Error("wrong completion time:", status.Completed.Sub(start))
+	}
+}
+
+func TestTriggerTaskOutcome(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	var runs int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		n := atomic.AddInt32(&runs, 1)
+		if n == 1 {
+			close(started)
+			<-release
+			return
+		}
+		err = fmt.Errorf("run %d failed", n)
+		return
+	}, start)
+	<-started
+
+	// triggered while running, the channel waits for the next run
+	done, err := sch.TriggerTask("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err == nil || err.Error() != "run 2 failed" {
+		t.Error("wrong outcome of the triggered run:", err)
+	}
+
+	// the run never starts once the task is removed
+	done, err = sch.RescheduleTask("1", start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch.RemoveTask("1")
+	if err := <-done; err != ErrTaskNotFound {
+		t.Error("expected ErrTaskNotFound, actual:", err)
+	}
+
+	if _, err := sch.TriggerTask("1"); err != ErrTaskNotFound {
+		t.Error("wrong error of a missing task:", err)
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	sch := New(&Config{Clock: clock, HistoryLimit: 2})
+	go sch.Start()
+	defer sch.Stop()
+
+	var n int
+	errChan := sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		n++
+		result = fmt.Sprint(n)
+		if n < 3 {
+			nextUpdate = clock.Now()
+		}
+		return
+	})
+	<-errChan
+	sch.WaitIdle()
+
+	records, err := sch.GetHistory("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Status != "completed: 3" || records[1].Status != "completed: 2" {
+		t.Error("wrong history:", records)
+	}
+}
+
+func TestPauseAndResumeAll(t *testing.T) {
+	var runs [3]int32
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock})
+	go sch.Start()
+	defer sch.Stop()
+
+	for i := range runs {
+		i := i
+		sch.SetScheduledTask(fmt.Sprint(i), func(task *Task) (result string, nextUpdate time.Time, err error) {
+			atomic.AddInt32(&runs[i], 1)
+			return
+		}, start.Add(50*time.Millisecond))
+	}
+	if err := sch.PauseTask("2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sch.PauseAll(); err != nil {
+		t.Fatal(err)
+	}
+	// the triggered run waits for ResumeAll as well
+	if _, err := sch.RescheduleTask("1", start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sch.TriggerTask("1"); err != nil {
+		t.Fatal(err)
+	}
+	sch.WaitIdle()
+	clock.Advance(100 * time.Millisecond)
+	sch.WaitIdle()
+	for i := range runs {
+		if n := atomic.LoadInt32(&runs[i]); n != 0 {
+			t.Error("task should not run while the scheduler is paused. actual runs:", n)
+		}
+	}
+	for _, status := range sch.GetTasks() {
+		if !status.Paused {
+			t.Error("task should be paused with the scheduler:", status)
+		}
+	}
+
+	// the overdue tasks run once resumed, except the task paused by itself
+	if err := sch.ResumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	sch.WaitIdle()
+	if n := [3]int32{atomic.LoadInt32(&runs[0]), atomic.LoadInt32(&runs[1]), atomic.LoadInt32(&runs[2])}; n != [3]int32{1, 1, 0} {
+		t.Error("wrong runs after resumed:", n)
+	}
+	if status, _ := sch.GetTask("2"); !status.Paused {
+		t.Error("task paused by PauseTask should stay paused:", status)
+	}
+}
+
+func TestResumeDisabledTask(t *testing.T) {
+	var runs int32
+	sch := New(&Config{})
+	go sch.Start()
+	defer sch.Stop()
+
+	<-sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		atomic.AddInt32(&runs, 1)
+		return
+	})
+	if status, _ := sch.GetTask("1"); !status.Disabled {
+		t.Fatal("task should be disabled:", status)
+	}
+
+	if err := sch.ResumeTask("1"); err != nil {
+		t.Fatal(err)
+	}
+	sch.WaitIdle()
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Error("resumed task should run again. actual runs:", n)
+	}
+}
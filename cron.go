@@ -0,0 +1,328 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes the activation times of a repeating task.
+type Schedule interface {
+	// Next returns the first activation time later than t, or zero time if
+	// there is none.
+	Next(t time.Time) time.Time
+}
+
+// ErrInvalidCronSpec is returned when a cron spec cannot be parsed.
+var ErrInvalidCronSpec = errors.New("bj4: invalid cron spec")
+
+// ErrNoActivation is returned when a cron spec never activates, e.g. on
+// February 30th.
+var ErrNoActivation = errors.New("bj4: cron spec has no next activation")
+
+type cronField struct {
+	name     string
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	secondField = cronField{name: "second", min: 0, max: 59}
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12, names: map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = cronField{name: "day of week", min: 0, max: 7, names: map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// starBit marks a field that was given as "*" or "?".
+const starBit = 1 << 63
+
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	location                              *time.Location
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+// ParseSchedule parses a cron spec.  Both the standard 5-field form (minute,
+// hour, day of month, month, day of week) and the 6-field form with a leading
+// second field are accepted, as well as the descriptors @yearly, @annually,
+// @monthly, @weekly, @daily, @midnight, @hourly and "@every <duration>".
+//
+// Activation times are computed in the location of the time given to Next,
+// unless the spec is prefixed with "CRON_TZ=<location> " or "TZ=<location> ".
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	var loc *time.Location
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%w: missing fields after time zone in %q", ErrInvalidCronSpec, spec)
+		}
+		name := spec[strings.Index(spec, "=")+1 : i]
+		var err error
+		loc, err = time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown time zone %q", ErrInvalidCronSpec, name)
+		}
+		spec = strings.TrimSpace(spec[i:])
+	}
+
+	if strings.HasPrefix(spec, "@every") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every")))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: invalid interval in %q", ErrInvalidCronSpec, spec)
+		}
+		return &everySchedule{interval: d}, nil
+	}
+
+	if expanded, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	} else if strings.HasPrefix(spec, "@") {
+		return nil, fmt.Errorf("%w: unknown descriptor %q", ErrInvalidCronSpec, spec)
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("%w: expected 5 or 6 fields, got %d in %q", ErrInvalidCronSpec, len(fields), spec)
+	}
+
+	s := &cronSchedule{location: loc}
+	var err error
+	for i, f := range []struct {
+		dst   *uint64
+		field cronField
+	}{
+		{&s.second, secondField},
+		{&s.minute, minuteField},
+		{&s.hour, hourField},
+		{&s.dom, domField},
+		{&s.month, monthField},
+		{&s.dow, dowField},
+	} {
+		if *f.dst, err = parseCronField(fields[i], f.field); err != nil {
+			return nil, err
+		}
+	}
+	// both 0 and 7 stand for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	return s, nil
+}
+
+func parseCronField(expr string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		b, err := parseCronRange(part, field)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+func parseCronRange(expr string, field cronField) (uint64, error) {
+	invalid := func() error {
+		return fmt.Errorf("%w: invalid %s %q", ErrInvalidCronSpec, field.name, expr)
+	}
+
+	rangeExpr, step := expr, uint(1)
+	hasStep := false
+	if i := strings.Index(expr, "/"); i >= 0 {
+		n, err := strconv.ParseUint(expr[i+1:], 10, 8)
+		if err != nil || n == 0 {
+			return 0, invalid()
+		}
+		rangeExpr, step, hasStep = expr[:i], uint(n), true
+	}
+
+	var start, end uint
+	var extra uint64
+	switch {
+	case rangeExpr == "*" || rangeExpr == "?":
+		start, end = field.min, field.max
+		if !hasStep {
+			extra = starBit
+		}
+	case strings.Contains(rangeExpr, "-"):
+		i := strings.Index(rangeExpr, "-")
+		var ok1, ok2 bool
+		start, ok1 = parseCronValue(rangeExpr[:i], field)
+		end, ok2 = parseCronValue(rangeExpr[i+1:], field)
+		if !ok1 || !ok2 {
+			return 0, invalid()
+		}
+	default:
+		var ok bool
+		if start, ok = parseCronValue(rangeExpr, field); !ok {
+			return 0, invalid()
+		}
+		end = start
+		if hasStep {
+			end = field.max
+		}
+	}
+	if start > end {
+		return 0, invalid()
+	}
+
+	var bits uint64
+	for v := start; v <= end; v += step {
+		bits |= 1 << v
+	}
+	return bits | extra, nil
+}
+
+func parseCronValue(s string, field cronField) (uint, bool) {
+	if v, ok := field.names[strings.ToLower(s)]; ok {
+		return v, true
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || uint(n) < field.min || uint(n) > field.max {
+		return 0, false
+	}
+	return uint(n), true
+}
+
+func (s *everySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	origLoc := t.Location()
+	loc := origLoc
+	if s.location != nil {
+		loc = s.location
+		t = t.In(loc)
+	}
+
+	// start from the next whole second
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	truncated := false
+	yearLimit := t.Year() + 5
+
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for s.month&(1<<uint(t.Month())) == 0 {
+		if !truncated {
+			truncated = true
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		}
+		t = t.AddDate(0, 1, 0)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !s.dayMatches(t) {
+		if !truncated {
+			truncated = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		}
+		t = t.AddDate(0, 0, 1)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for s.hour&(1<<uint(t.Hour())) == 0 {
+		if !truncated {
+			truncated = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		}
+		t = t.Add(time.Hour)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for s.minute&(1<<uint(t.Minute())) == 0 {
+		if !truncated {
+			truncated = true
+			t = t.Truncate(time.Minute)
+		}
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	for s.second&(1<<uint(t.Second())) == 0 {
+		truncated = true
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto wrap
+		}
+	}
+
+	return t.In(origLoc)
+}
+
+// dayMatches follows the cron convention: when both day of month and day of
+// week are restricted, a day matching either of them is accepted.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.dom&starBit != 0 || s.dow&starBit != 0 {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
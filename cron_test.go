@@ -0,0 +1,110 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	utc := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	cases := []struct {
+		spec     string
+		from     string
+		expected string
+	}{
+		{"0 3 * * *", "2017-05-01 02:59:59", "2017-05-01 03:00:00"},
+		{"0 3 * * *", "2017-05-01 03:00:00", "2017-05-02 03:00:00"},
+		{"*/15 * * * *", "2017-05-01 10:07:00", "2017-05-01 10:15:00"},
+		{"30 */10 * * * *", "2017-05-01 10:07:00", "2017-05-01 10:10:30"},
+		{"0 0 1 * *", "2017-12-15 00:00:00", "2018-01-01 00:00:00"},
+		{"0 0 * * MON-FRI", "2017-05-05 12:00:00", "2017-05-08 00:00:00"},
+		{"0 0 * * 7", "2017-05-01 00:00:00", "2017-05-07 00:00:00"},
+		{"0 0 13 * FRI", "2017-05-01 00:00:00", "2017-05-05 00:00:00"},
+		{"0 0 29 FEB *", "2017-03-01 00:00:00", "2020-02-29 00:00:00"},
+		{"@hourly", "2017-05-01 10:07:00", "2017-05-01 11:00:00"},
+		{"@daily", "2017-05-01 10:07:00", "2017-05-02 00:00:00"},
+		{"@weekly", "2017-05-01 10:07:00", "2017-05-07 00:00:00"},
+		{"@monthly", "2017-05-01 10:07:00", "2017-06-01 00:00:00"},
+		{"@yearly", "2017-05-01 10:07:00", "2018-01-01 00:00:00"},
+		{"@every 5m", "2017-05-01 10:07:00", "2017-05-01 10:12:00"},
+		{"CRON_TZ=Asia/Taipei 0 3 * * *", "2017-05-01 00:00:00", "2017-05-01 19:00:00"},
+	}
+
+	for _, c := range cases {
+		s, err := ParseSchedule(c.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.spec, err)
+			continue
+		}
+		next := s.Next(utc(c.from))
+		if !next.Equal(utc(c.expected)) {
+			t.Errorf("%q from %s: expected %s, actual %s", c.spec, c.from, c.expected, next)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"@every",
+		"@every -1s",
+		"@fortnightly",
+		"TZ=Nowhere/Special * * * * *",
+	} {
+		if _, err := ParseSchedule(spec); !errors.Is(err, ErrInvalidCronSpec) {
+			t.Errorf("%q: expected ErrInvalidCronSpec, actual: %v", spec, err)
+		}
+	}
+
+	s, err := ParseSchedule("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Error("expected no activation, actual:", next)
+	}
+}
@@ -0,0 +1,145 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+const defaultLeaseTTL = 15 * time.Second
+
+// LeaderElector is an interface for bj4 to elect a leader among the replicas
+// of a scheduler, so that only the leader runs tasks.
+type LeaderElector interface {
+	// Campaign acquires the leadership for id if no one else holds it, or
+	// renews it if id holds it already.  The leadership lasts for ttl unless
+	// renewed.  Returns whether id is the leader, and the fencing token of
+	// the leadership, which increases every time the leadership changes
+	// hands.
+	Campaign(ctx context.Context, id string, ttl time.Duration) (token uint64, leader bool, err error)
+
+	// Resign gives up the leadership if id holds it.
+	Resign(ctx context.Context, id string) error
+}
+
+// lease is the state of the leadership shared by the implementations of
+// LeaderElector in this package.
+type lease struct {
+	Holder string
+	Expiry time.Time
+	Token  uint64
+}
+
+func (l *lease) campaign(id string, ttl time.Duration, now time.Time) (uint64, bool) {
+	if l.Holder != id && l.Holder != "" && now.Before(l.Expiry) {
+		return l.Token, false
+	}
+	if l.Holder != id {
+		l.Holder = id
+		l.Token++
+	}
+	l.Expiry = now.Add(ttl)
+	return l.Token, true
+}
+
+func (l *lease) resign(id string) {
+	if l.Holder == id {
+		l.Holder = ""
+		l.Expiry = time.Time{}
+	}
+}
+
+func defaultElectorID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// campaign acquires or renews the leadership every third of the lease TTL.
+// If the elector fails, the leadership is kept until the lease expires.
+// Tasks running when the leadership is lost are cancelled.
+func (bj4 *BJ4) campaign() {
+	if bj4.elector == nil {
+		return
+	}
+	now := bj4.clock.Now()
+	if now.Before(bj4.nextCampaign) {
+		return
+	}
+	bj4.nextCampaign = now.Add(bj4.leaseTTL / 3)
+
+	ctx, cancel := context.WithTimeout(bj4.ctx, bj4.leaseTTL/3)
+	token, leader, err := bj4.elector.Campaign(ctx, bj4.electorID, bj4.leaseTTL)
+	cancel()
+
+	switch {
+	case err != nil:
+		if bj4.leader && !now.Before(bj4.leaseExpiry) {
+			bj4.loseLeadership(err)
+		}
+	case leader:
+		bj4.leaseExpiry = now.Add(bj4.leaseTTL)
+		if !bj4.leader || token != bj4.token {
+			bj4.leader = true
+			bj4.token = token
+			bj4.logger.OnLeadershipGained(token)
+		}
+	case bj4.leader:
+		bj4.loseLeadership(nil)
+	}
+}
+
+func (bj4 *BJ4) loseLeadership(err error) {
+	bj4.leader = false
+	bj4.mu.Lock()
+	for _, cancel := range bj4.running {
+		cancel()
+	}
+	bj4.mu.Unlock()
+	bj4.logger.OnLeadershipLost(err)
+}
+
+// resign gives up the leadership when the scheduler stops, so that another
+// replica can take over without waiting for the lease to expire.
+func (bj4 *BJ4) resign() {
+	if bj4.elector == nil || !bj4.leader {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), bj4.leaseTTL/3)
+	defer cancel()
+	bj4.elector.Resign(ctx, bj4.electorID)
+	bj4.loseLeadership(nil)
+}
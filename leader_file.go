@@ -0,0 +1,112 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// FileElector implements LeaderElector with a lease file, so that the
+// schedulers of processes on the same host can elect a leader.  The file is
+// locked while the lease is read and written.  It is only supported on Unix.
+type FileElector struct {
+	path  string
+	clock Clock
+}
+
+// NewFileElector creates a FileElector keeping the lease in the file at path.
+// The file is created if it does not exist.
+func NewFileElector(path string) *FileElector {
+	return &FileElector{path: path, clock: RealClock{}}
+}
+
+func (e *FileElector) Campaign(ctx context.Context, id string, ttl time.Duration) (token uint64, leader bool, err error) {
+	err = e.update(func(l *lease) {
+		token, leader = l.campaign(id, ttl, e.clock.Now())
+	})
+	return
+}
+
+func (e *FileElector) Resign(ctx context.Context, id string) error {
+	return e.update(func(l *lease) {
+		l.resign(id)
+	})
+}
+
+// update locks the lease file, and rewrites the lease modified by fn.
+func (e *FileElector) update(fn func(l *lease)) error {
+	var l lease
+	return updateFile(e.path, &l, func() {
+		fn(&l)
+	})
+}
+
+// updateFile locks the file at path, decodes its JSON content into v, calls fn
+// to modify v, and rewrites the file with v.  The file is created if it does
+// not exist.
+func updateFile(path string, v interface{}, fn func()) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+
+	fn()
+
+	if data, err = json.Marshal(v); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,170 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testElector(t *testing.T, elector LeaderElector, clock *FakeClock) {
+	ctx := context.Background()
+	ttl := 100 * time.Millisecond
+
+	token, leader, err := elector.Campaign(ctx, "a", ttl)
+	if err != nil || !leader || token != 1 {
+		t.Fatal("a should be the leader with token 1:", token, leader, err)
+	}
+	if _, leader, _ := elector.Campaign(ctx, "b", ttl); leader {
+		t.Error("b should not be the leader while a holds the lease")
+	}
+	if token, leader, _ := elector.Campaign(ctx, "a", ttl); !leader || token != 1 {
+		t.Error("a should renew the lease with the same token:", token, leader)
+	}
+
+	// the lease expires
+	clock.Advance(ttl - 1)
+	if _, leader, _ := elector.Campaign(ctx, "b", ttl); leader {
+		t.Error("b should not be the leader before the lease expires")
+	}
+	clock.Advance(1)
+	if token, leader, _ := elector.Campaign(ctx, "b", ttl); !leader || token != 2 {
+		t.Error("b should take over the expired lease with token 2:", token, leader)
+	}
+
+	// resigning lets another take over immediately
+	if err := elector.Resign(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, leader, _ := elector.Campaign(ctx, "a", ttl); leader {
+		t.Error("a should not resign a lease held by b")
+	}
+	if err := elector.Resign(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if token, leader, _ := elector.Campaign(ctx, "a", ttl); !leader || token != 3 {
+		t.Error("a should take over the resigned lease with token 3:", token, leader)
+	}
+}
+
+func TestMemoryElector(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	elector := NewMemoryElector()
+	elector.clock = clock
+	testElector(t, elector, clock)
+}
+
+func TestFileElector(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	elector := NewFileElector(path)
+	elector.clock = clock
+	testElector(t, elector, clock)
+
+	// the lease is shared by electors on the same file
+	other := NewFileElector(path)
+	other.clock = clock
+	if token, leader, _ := other.Campaign(context.Background(), "a", time.Second); !leader || token != 3 {
+		t.Error("a should still hold the lease with token 3:", token, leader)
+	}
+}
+
+func TestOnlyLeaderRunsTasks(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	elector := NewMemoryElector()
+	elector.clock = clock
+	var counts [2]int32
+	var schs [2]*BJ4
+	for i := range schs {
+		i := i
+		schs[i] = New(&Config{Clock: clock, Elector: elector, LeaseTTL: 300 * time.Millisecond})
+		go schs[i].Start()
+		defer schs[i].Stop()
+		schs[i].SetCronTask("1", "@every 50ms", func(task *Task) (result string, nextUpdate time.Time, err error) {
+			atomic.AddInt32(&counts[i], 1)
+			return
+		})
+	}
+
+	// advance takes the time in steps, letting the running schedulers catch
+	// up on every step
+	advance := func(d time.Duration, schs ...*BJ4) {
+		for ; d > 0; d -= 50 * time.Millisecond {
+			for _, sch := range schs {
+				sch.WaitIdle()
+			}
+			clock.Advance(50 * time.Millisecond)
+		}
+		for _, sch := range schs {
+			sch.WaitIdle()
+		}
+	}
+
+	advance(400*time.Millisecond, schs[:]...)
+	a, b := atomic.LoadInt32(&counts[0]), atomic.LoadInt32(&counts[1])
+	if (a == 0) == (b == 0) {
+		t.Fatal("exactly one replica should run the task:", a, b)
+	}
+	leader, follower := 0, 1
+	if a == 0 {
+		leader, follower = 1, 0
+	}
+
+	// the follower takes over once the leader stops
+	schs[leader].Stop()
+	advance(300*time.Millisecond, schs[follower])
+	if atomic.LoadInt32(&counts[follower]) == 0 {
+		t.Error("the follower should run the task after the leader stops")
+	}
+}
+
+func TestFencingToken(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	elector := NewMemoryElector()
+	elector.clock = clock
+	elector.Campaign(context.Background(), "other", time.Millisecond)
+	clock.Advance(time.Millisecond)
+
+	var token uint64
+	sch := New(&Config{Clock: clock, Elector: elector})
+	go sch.Start()
+	<-sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		token = task.FencingToken()
+		return
+	})
+	sch.Stop()
+
+	if token != 2 {
+		t.Error("wrong fencing token. expected: 2, actual:", token)
+	}
+}
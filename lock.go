@@ -0,0 +1,140 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const defaultLockTTL = time.Minute
+
+const statusLockHeld = "lock held elsewhere"
+
+// ErrLockHeld is received from the channel returned by TriggerTask or
+// RescheduleTask if the run is skipped because its lock is held elsewhere.
+var ErrLockHeld = errors.New("bj4 task lock held elsewhere")
+
+// LockProvider is an interface for bj4 to lock every run of a task, so that
+// replicas of a scheduler sharing the tasks run each of them exactly once.  A
+// run is identified by the name of the task and the time it is due, which is
+// the same on every replica for tasks with a schedule.  A run started by
+// TriggerTask is due at the time it is triggered.
+type LockProvider interface {
+	// Lock acquires the lock of the run of the task due at due for owner,
+	// or renews it if owner holds it already.  The lock lasts for ttl
+	// unless renewed or released.  Returns false if another owner holds
+	// the lock of the task, or if a run of the task due at or after due is
+	// done already.
+	Lock(ctx context.Context, name string, due time.Time, owner string, ttl time.Duration) (bool, error)
+
+	// Unlock releases the lock of the task if owner holds it, and records
+	// that the run due at due is done.
+	Unlock(ctx context.Context, name string, due time.Time, owner string) error
+}
+
+// taskLock is the state of the lock of a task shared by the implementations of
+// LockProvider in this package.
+type taskLock struct {
+	Owner  string
+	Expiry time.Time
+	Done   time.Time
+}
+
+func (l *taskLock) lock(due time.Time, owner string, ttl time.Duration, now time.Time) bool {
+	if l.Owner != owner && l.Owner != "" && now.Before(l.Expiry) {
+		return false
+	}
+	if l.Owner != owner && !l.Done.IsZero() && !l.Done.Before(due) {
+		return false
+	}
+	l.Owner = owner
+	l.Expiry = now.Add(ttl)
+	return true
+}
+
+func (l *taskLock) unlock(due time.Time, owner string) {
+	if l.Owner != owner {
+		return
+	}
+	l.Owner = ""
+	l.Expiry = time.Time{}
+	if due.After(l.Done) {
+		l.Done = due
+	}
+}
+
+// lock acquires the lock of a run, and renews it every third of the lock TTL
+// until the returned function is called to release it.  If the lock cannot be
+// renewed, cancel is called to cancel the run.  The lock is renewed without
+// ctx, which is done once the run times out.
+func (task *Task) lock(ctx context.Context, due time.Time, cancel context.CancelFunc) (bool, func(), error) {
+	bj4 := task.bj4
+	if bj4.locker == nil {
+		return true, func() {}, nil
+	}
+	ok, err := bj4.locker.Lock(ctx, task.Name, due, bj4.electorID, bj4.lockTTL)
+	if !ok || err != nil {
+		return false, nil, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		timer := bj4.clock.NewTimer(bj4.lockTTL / 3)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C():
+				timer.Reset(bj4.lockTTL / 3)
+				ctx, cancelLock := context.WithTimeout(context.Background(), bj4.lockTTL/3)
+				ok, err := bj4.locker.Lock(ctx, task.Name, due, bj4.electorID, bj4.lockTTL)
+				cancelLock()
+				if !ok || err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	unlock := func() {
+		close(done)
+		<-stopped
+		ctx, cancel := context.WithTimeout(context.Background(), bj4.lockTTL/3)
+		defer cancel()
+		bj4.locker.Unlock(ctx, task.Name, due, bj4.electorID)
+	}
+	return true, unlock, nil
+}
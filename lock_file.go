@@ -0,0 +1,71 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// FileLocker implements LockProvider with a lock file per task in a directory,
+// so that the schedulers of processes on the same host can share the tasks.
+// The file is locked while the lock is read and written.  It is only supported
+// on Unix.
+type FileLocker struct {
+	dir   string
+	clock Clock
+}
+
+// NewFileLocker creates a FileLocker keeping the lock files in dir, which
+// must exist.
+func NewFileLocker(dir string) *FileLocker {
+	return &FileLocker{dir: dir, clock: RealClock{}}
+}
+
+func (l *FileLocker) Lock(ctx context.Context, name string, due time.Time, owner string, ttl time.Duration) (ok bool, err error) {
+	var lock taskLock
+	err = updateFile(l.path(name), &lock, func() {
+		ok = lock.lock(due, owner, ttl, l.clock.Now())
+	})
+	return
+}
+
+func (l *FileLocker) Unlock(ctx context.Context, name string, due time.Time, owner string) error {
+	var lock taskLock
+	return updateFile(l.path(name), &lock, func() {
+		lock.unlock(due, owner)
+	})
+}
+
+func (l *FileLocker) path(name string) string {
+	return filepath.Join(l.dir, url.PathEscape(name)+".lock")
+}
@@ -0,0 +1,235 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLocker(t *testing.T, locker LockProvider, clock *FakeClock) {
+	ctx := context.Background()
+	ttl := 100 * time.Millisecond
+	due := clock.Now().Truncate(time.Second)
+
+	if ok, err := locker.Lock(ctx, "1", due, "a", ttl); !ok || err != nil {
+		t.Fatal("a should acquire the lock:", ok, err)
+	}
+	if ok, _ := locker.Lock(ctx, "1", due, "b", ttl); ok {
+		t.Error("b should not acquire the lock held by a")
+	}
+	if ok, _ := locker.Lock(ctx, "2", due, "b", ttl); !ok {
+		t.Error("b should acquire the lock of another task")
+	}
+	if ok, _ := locker.Lock(ctx, "1", due, "a", ttl); !ok {
+		t.Error("a should renew the lock")
+	}
+
+	// the run due at due is done
+	if err := locker.Unlock(ctx, "1", due, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := locker.Lock(ctx, "1", due, "b", ttl); ok {
+		t.Error("b should not acquire the lock of a run done already")
+	}
+	if ok, _ := locker.Lock(ctx, "1", due.Add(time.Second), "b", ttl); !ok {
+		t.Error("b should acquire the lock of the next run")
+	}
+
+	// the lock expires
+	clock.Advance(ttl - 1)
+	if ok, _ := locker.Lock(ctx, "1", due.Add(time.Second), "a", ttl); ok {
+		t.Error("a should not acquire the lock before it expires")
+	}
+	clock.Advance(1)
+	if ok, _ := locker.Lock(ctx, "1", due.Add(time.Second), "a", ttl); !ok {
+		t.Error("a should acquire the expired lock")
+	}
+}
+
+func TestMemoryLocker(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewMemoryLocker()
+	locker.clock = clock
+	testLocker(t, locker, clock)
+}
+
+func TestFileLocker(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewFileLocker(t.TempDir())
+	locker.clock = clock
+	testLocker(t, locker, clock)
+}
+
+func TestLockedRunIsSkipped(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	locker := NewMemoryLocker()
+	locker.clock = clock
+
+	var mu sync.Mutex
+	var count int
+	var schs [2]*BJ4
+	for i := range schs {
+		schs[i] = New(&Config{Clock: clock, Locker: locker})
+		go schs[i].Start()
+		defer schs[i].Stop()
+		schs[i].SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+			mu.Lock()
+			count++
+			mu.Unlock()
+			return
+		}, start.Add(50*time.Millisecond))
+	}
+	for _, sch := range schs {
+		sch.WaitIdle()
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	var skipped int
+	for _, sch := range schs {
+		sch.WaitIdle()
+		if strings.HasPrefix(sch.GetTasks()[0].Status, "skipped: ") {
+			skipped++
+		}
+	}
+	if skipped != 1 {
+		t.Error("the run of one replica should be skipped. actual:", skipped)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 1 {
+		t.Error("the task should run exactly once. actual:", count)
+	}
+}
+
+func TestLockedTriggeredRun(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sch := New(&Config{Clock: clock, Locker: NewMemoryLocker()})
+	go sch.Start()
+	defer sch.Stop()
+
+	var runs int
+	sch.SetScheduledTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		runs++
+		return
+	}, start.Add(time.Hour))
+	done, err := sch.TriggerTask("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("triggered run failed:", err)
+	}
+
+	// the triggered run does not take the place of the scheduled one
+	clock.Advance(time.Hour)
+	sch.WaitIdle()
+	status, _ := sch.GetTask("1")
+	if runs != 2 || strings.HasPrefix(status.Status, "skipped: ") {
+		t.Error("scheduled run should not be skipped:", runs, status)
+	}
+}
+
+func TestLockHeldUntilTimedOutRunReturns(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	locker := NewMemoryLocker()
+	locker.clock = clock
+	sch := New(&Config{Clock: clock, Locker: locker, ElectorID: "a", TaskTimeout: time.Minute, LockTTL: 3 * time.Minute})
+	go sch.Start()
+	defer sch.Stop()
+
+	started := make(chan struct{})
+	hang := make(chan struct{})
+	defer close(hang)
+	errChan := sch.SetTask("1", func(task *Task) (result string, nextUpdate time.Time, err error) {
+		close(started)
+		<-hang
+		return
+	})
+	<-started
+	clock.Advance(time.Minute)
+	if err := <-errChan; err != ErrTaskTimeout {
+		t.Fatal("expected ErrTaskTimeout, actual:", err)
+	}
+
+	// another replica cannot run the task while the function is running
+	if ok, _ := locker.Lock(context.Background(), "1", start.Add(time.Hour), "b", time.Minute); ok {
+		t.Error("the lock should be held until the timed out function returns")
+	}
+}
+
+func TestLockedCronRunsOnce(t *testing.T) {
+	clock := NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	locker := NewMemoryLocker()
+	locker.clock = clock
+
+	var mu sync.Mutex
+	runs := make(map[time.Time]int)
+	var schs [2]*BJ4
+	for i := range schs {
+		schs[i] = New(&Config{Clock: clock, Locker: locker, ElectorID: string(rune('a' + i))})
+		go schs[i].Start()
+		defer schs[i].Stop()
+		schs[i].SetCronTask("1", "* * * * * *", func(task *Task) (result string, nextUpdate time.Time, err error) {
+			mu.Lock()
+			runs[task.NextUpdate]++
+			mu.Unlock()
+			return
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, sch := range schs {
+			sch.WaitIdle()
+		}
+		clock.Advance(time.Second)
+	}
+	for _, sch := range schs {
+		sch.WaitIdle()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(runs) != 3 {
+		t.Error("the task should run every second:", runs)
+	}
+	for due, n := range runs {
+		if n != 1 {
+			t.Error("the run due at", due, "should be done once. actual:", n)
+		}
+	}
+}
@@ -29,6 +29,8 @@
 
 package bj4
 
+import "time"
+
 // Logger is an interface for bj4 to log.
 type Logger interface {
 	// OnStart will run when bj4 is started.
@@ -50,4 +52,34 @@ type Logger interface {
 
 	// OnTaskError will run when a task returns an error.
 	OnTaskError(task *Task, err error)
+
+	// OnTaskTimeout will run when a task does not return before its
+	// timeout.
+	OnTaskTimeout(task *Task)
+
+	// OnTaskRetry will run when a failed run of a task is scheduled to be
+	// retried after delay.
+	OnTaskRetry(task *Task, err error, delay time.Duration)
+
+	// OnStoreError will run when the status of a task cannot be saved to
+	// or deleted from the Store.
+	OnStoreError(task *Task, err error)
+
+	// OnTaskSkipped will run when a run of a task is skipped because its
+	// lock is held elsewhere.  err is the error of the LockProvider if the
+	// lock could not be acquired because of it, or nil otherwise.
+	OnTaskSkipped(task *Task, err error)
+
+	// OnTaskMisfire will run when a task misfires.  missed is the number
+	// of activations which have passed, including the one the task was
+	// due at.  See MisfirePolicy.
+	OnTaskMisfire(task *Task, missed int)
+
+	// OnLeadershipGained will run when the scheduler becomes the leader.
+	OnLeadershipGained(token uint64)
+
+	// OnLeadershipLost will run when the scheduler is not the leader
+	// anymore.  err is the error of the LeaderElector if the leadership
+	// could not be renewed, or nil otherwise.
+	OnLeadershipLost(err error)
 }
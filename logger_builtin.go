@@ -29,7 +29,10 @@
 
 package bj4
 
-import "log"
+import (
+	"log"
+	"time"
+)
 
 // BuiltinLogger implements Logger. It uses log.Printf and log.Println for
 // logging.
@@ -48,7 +51,8 @@ func (lgr *BuiltinLogger) OnTaskStart(task *Task) {
 }
 
 func (lgr *BuiltinLogger) OnTaskStatusUpdate(task *Task) {
-	log.Printf("task \"%s\" update: %s\n", task.Name, task.Status)
+	status := task.Snapshot()
+	log.Printf("task \"%s\" update: %s\n", status.Name, status.Status)
 }
 
 func (lgr *BuiltinLogger) OnTaskComplete(task *Task, result string) {
@@ -58,3 +62,39 @@ func (lgr *BuiltinLogger) OnTaskComplete(task *Task, result string) {
 func (lgr *BuiltinLogger) OnTaskError(task *Task, err error) {
 	log.Printf("task \"%s\" error: %s\n", task.Name, err.Error())
 }
+
+func (lgr *BuiltinLogger) OnTaskTimeout(task *Task) {
+	log.Printf("task \"%s\" timed out\n", task.Name)
+}
+
+func (lgr *BuiltinLogger) OnTaskRetry(task *Task, err error, delay time.Duration) {
+	log.Printf("task \"%s\" attempt %d error: %s, retrying in %s\n", task.Name, task.Attempt, err.Error(), delay)
+}
+
+func (lgr *BuiltinLogger) OnStoreError(task *Task, err error) {
+	log.Printf("task \"%s\" store error: %s\n", task.Name, err.Error())
+}
+
+func (lgr *BuiltinLogger) OnTaskSkipped(task *Task, err error) {
+	if err != nil {
+		log.Printf("task \"%s\" skipped: %s\n", task.Name, err.Error())
+		return
+	}
+	log.Printf("task \"%s\" skipped: %s\n", task.Name, statusLockHeld)
+}
+
+func (lgr *BuiltinLogger) OnTaskMisfire(task *Task, missed int) {
+	log.Printf("task \"%s\" misfired, %d activations missed\n", task.Name, missed)
+}
+
+func (lgr *BuiltinLogger) OnLeadershipGained(token uint64) {
+	log.Printf("bj4 gained leadership, token %d\n", token)
+}
+
+func (lgr *BuiltinLogger) OnLeadershipLost(err error) {
+	if err != nil {
+		log.Printf("bj4 lost leadership: %s\n", err.Error())
+		return
+	}
+	log.Println("bj4 lost leadership")
+}
@@ -29,7 +29,11 @@
 
 package bj4
 
-import log "github.com/sirupsen/logrus"
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
 
 // LogrusLogger implements Logger and uses sirupsen/logrus to log. This logger
 // provides more verbose information than BuiltinLogger.
@@ -56,10 +60,11 @@ func (lgr *LogrusLogger) OnTaskStart(task *Task) {
 }
 
 func (lgr *LogrusLogger) OnTaskStatusUpdate(task *Task) {
+	status := task.Snapshot()
 	log.WithFields(log.Fields{
-		"task": task.TaskStatus,
+		"task": status,
 		"pool": "bj4",
-	}).Infof("task \"%s\" update: %s", task.Name, task.Status)
+	}).Infof("task \"%s\" update: %s", status.Name, status.Status)
 }
 
 func (lgr *LogrusLogger) OnTaskComplete(task *Task, result string) {
@@ -75,3 +80,63 @@ func (lgr *LogrusLogger) OnTaskError(task *Task, err error) {
 		"pool": "bj4",
 	}).Errorf("task \"%s\" error: %s", task.Name, err.Error())
 }
+
+func (lgr *LogrusLogger) OnTaskTimeout(task *Task) {
+	log.WithFields(log.Fields{
+		"task": task.TaskStatus,
+		"pool": "bj4",
+	}).Errorf("task \"%s\" timed out", task.Name)
+}
+
+func (lgr *LogrusLogger) OnTaskRetry(task *Task, err error, delay time.Duration) {
+	log.WithFields(log.Fields{
+		"task":  task.TaskStatus,
+		"pool":  "bj4",
+		"delay": delay,
+	}).Warnf("task \"%s\" attempt %d error: %s, retrying", task.Name, task.Attempt, err.Error())
+}
+
+func (lgr *LogrusLogger) OnStoreError(task *Task, err error) {
+	log.WithFields(log.Fields{
+		"task": task.TaskStatus,
+		"pool": "bj4",
+	}).Errorf("task \"%s\" store error: %s", task.Name, err.Error())
+}
+
+func (lgr *LogrusLogger) OnTaskSkipped(task *Task, err error) {
+	entry := log.WithFields(log.Fields{
+		"task": task.TaskStatus,
+		"pool": "bj4",
+	})
+	if err != nil {
+		entry.Errorf("task \"%s\" skipped: %s", task.Name, err.Error())
+		return
+	}
+	entry.Infof("task \"%s\" skipped: %s", task.Name, statusLockHeld)
+}
+
+func (lgr *LogrusLogger) OnTaskMisfire(task *Task, missed int) {
+	log.WithFields(log.Fields{
+		"task":   task.TaskStatus,
+		"pool":   "bj4",
+		"missed": missed,
+	}).Warnf("task \"%s\" misfired, %d activations missed", task.Name, missed)
+}
+
+func (lgr *LogrusLogger) OnLeadershipGained(token uint64) {
+	log.WithFields(log.Fields{
+		"pool":  "bj4",
+		"token": token,
+	}).Infof("task scheduler gained leadership")
+}
+
+func (lgr *LogrusLogger) OnLeadershipLost(err error) {
+	entry := log.WithFields(log.Fields{
+		"pool": "bj4",
+	})
+	if err != nil {
+		entry.Errorf("task scheduler lost leadership: %s", err.Error())
+		return
+	}
+	entry.Infof("task scheduler lost leadership")
+}
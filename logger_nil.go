@@ -29,6 +29,8 @@
 
 package bj4
 
+import "time"
+
 // NilLogger implements Logger and does nothing.  This is the default logger if
 // the logger in BJ4 config is left nil.
 type NilLogger struct{}
@@ -50,3 +52,24 @@ func (lgr *NilLogger) OnTaskComplete(task *Task, result string) {
 
 func (lgr *NilLogger) OnTaskError(task *Task, err error) {
 }
+
+func (lgr *NilLogger) OnTaskTimeout(task *Task) {
+}
+
+func (lgr *NilLogger) OnTaskRetry(task *Task, err error, delay time.Duration) {
+}
+
+func (lgr *NilLogger) OnStoreError(task *Task, err error) {
+}
+
+func (lgr *NilLogger) OnTaskSkipped(task *Task, err error) {
+}
+
+func (lgr *NilLogger) OnTaskMisfire(task *Task, missed int) {
+}
+
+func (lgr *NilLogger) OnLeadershipGained(token uint64) {
+}
+
+func (lgr *NilLogger) OnLeadershipLost(err error) {
+}
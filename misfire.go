@@ -0,0 +1,134 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"fmt"
+	"time"
+)
+
+// MisfirePolicy decides what to do with a task whose activation was missed,
+// because the scheduler was not running or was busy with other tasks.  A task
+// misfires when it is due at an activation of its schedule, and the next
+// activation has passed as well by the time the scheduler gets to it.
+// Misfire policies only apply to tasks with a schedule.
+type MisfirePolicy int
+
+const (
+	// MisfireFireOnce runs the task once, then schedules it on the next
+	// activation after the run.  This is the default.
+	MisfireFireOnce MisfirePolicy = iota
+	// MisfireCatchUp runs the task for every missed activation, one after
+	// another, until it catches up with its schedule.
+	MisfireCatchUp
+	// MisfireSkip skips the missed activations, and schedules the task on
+	// the next activation.
+	MisfireSkip
+	// MisfireSkipIfLate skips the activation if the task is late by more
+	// than the misfire threshold, and schedules the task on the next
+	// activation.  Otherwise the task is run once.
+	MisfireSkipIfLate
+)
+
+// maxMisfireCount caps the number of missed activations counted, so that a
+// frequent schedule missed for a long time does not block the scheduler.
+const maxMisfireCount = 100000
+
+// WithMisfire sets the misfire policy of the task.  threshold is only used by
+// MisfireSkipIfLate.  Logger.OnTaskMisfire is called whenever the task
+// misfires, or once for all the activations caught up with under
+// MisfireCatchUp.
+func WithMisfire(policy MisfirePolicy, threshold time.Duration) TaskOption {
+	return func(task *Task) {
+		task.misfire = policy
+		task.misfireThreshold = threshold
+	}
+}
+
+// missed counts the activations of the schedule from NextUpdate up to now,
+// including the one at NextUpdate.  A retry is not an activation, so that
+// nothing is missed while retrying.
+func (task *Task) missed(now time.Time) int {
+	if task.schedule == nil || task.Retrying || task.NextUpdate.After(now) {
+		return 0
+	}
+	n := 1
+	for t := task.schedule.Next(task.NextUpdate); n < maxMisfireCount; t = task.schedule.Next(t) {
+		if t.IsZero() || t.After(now) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// skipMisfire skips a due task as its misfire policy says, and schedules it on
+// the next activation.  Returns whether the task is skipped.
+func (task *Task) skipMisfire(now time.Time) bool {
+	if task.misfire != MisfireSkip && task.misfire != MisfireSkipIfLate {
+		return false
+	}
+	missed := task.missed(now)
+	switch {
+	case missed == 0:
+		return false
+	case task.misfire == MisfireSkip && missed < 2:
+		return false
+	case task.misfire == MisfireSkipIfLate && now.Sub(task.NextUpdate) <= task.misfireThreshold:
+		return false
+	}
+
+	task.bj4.logger.OnTaskMisfire(task, missed)
+	task.NextUpdate = task.schedule.Next(now)
+	if task.NextUpdate.IsZero() {
+		task.Disabled = true
+	}
+	task.Status = fmt.Sprintf("skipped: misfired, %d missed", missed)
+	return true
+}
+
+// reportMisfire reports a task which misfires, but runs anyway.  A task
+// catching up is reported on the first of the runs.
+func (task *Task) reportMisfire(now time.Time) {
+	missed := task.missed(now)
+	if missed <= 1 {
+		if !task.Retrying {
+			task.catchingUp = false
+		}
+		return
+	}
+	if task.misfire == MisfireCatchUp {
+		if task.catchingUp {
+			return
+		}
+		task.catchingUp = true
+	}
+	task.bj4.logger.OnTaskMisfire(task, missed)
+}
@@ -0,0 +1,156 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type misfireLogger struct {
+	NilLogger
+	mu     sync.Mutex
+	missed []int
+}
+
+func (lgr *misfireLogger) OnTaskMisfire(task *Task, missed int) {
+	lgr.mu.Lock()
+	lgr.missed = append(lgr.missed, missed)
+	lgr.mu.Unlock()
+}
+
+// misfireStart is the time the scheduler of testMisfire starts.
+var misfireStart = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testMisfire runs a task with the policy, which was due 350ms ago on a 100ms
+// schedule, and returns the number of runs until the scheduler is idle and the
+// missed counts reported.
+func testMisfire(t *testing.T, policy MisfirePolicy, threshold time.Duration) (int, []int, TaskStatus) {
+	store := NewMemoryStore()
+	store.Save(TaskStatus{Name: "1", NextUpdate: misfireStart.Add(-350 * time.Millisecond)})
+
+	var mu sync.Mutex
+	var runs int
+	lgr := &misfireLogger{}
+	sch := New(&Config{Clock: NewFakeClock(misfireStart), Store: store, Logger: lgr})
+	go sch.Start()
+	sch.Register("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		return
+	}, WithSchedule(&everySchedule{interval: 100 * time.Millisecond}), WithMisfire(policy, threshold))
+
+	sch.WaitIdle()
+	status := sch.GetTasks()[0]
+	sch.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	lgr.mu.Lock()
+	defer lgr.mu.Unlock()
+	return runs, lgr.missed, status
+}
+
+func TestMisfireFireOnce(t *testing.T) {
+	runs, missed, _ := testMisfire(t, MisfireFireOnce, 0)
+	if runs != 1 {
+		t.Error("the task should run once. actual:", runs)
+	}
+	if len(missed) != 1 || missed[0] != 4 {
+		t.Error("wrong missed activations. expected: [4], actual:", missed)
+	}
+}
+
+func TestMisfireCatchUp(t *testing.T) {
+	runs, missed, _ := testMisfire(t, MisfireCatchUp, 0)
+	if runs != 4 {
+		t.Error("the task should run for every missed activation. expected: 4, actual:", runs)
+	}
+	if len(missed) != 1 || missed[0] != 4 {
+		t.Error("wrong missed activations. expected: [4], actual:", missed)
+	}
+}
+
+func TestMisfireCatchUpReportedPerWindow(t *testing.T) {
+	clock := NewFakeClock(misfireStart)
+	lgr := &misfireLogger{}
+	sch := New(&Config{Clock: clock, Logger: lgr})
+	go sch.Start()
+	defer sch.Stop()
+
+	var runs int
+	sch.Register("1", func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		runs++
+		return
+	}, WithSchedule(&everySchedule{interval: 100 * time.Millisecond}), WithMisfire(MisfireCatchUp, 0))
+
+	// the activations at 100ms, 200ms and 300ms are missed, then the ones
+	// at 400ms, 500ms and 600ms
+	sch.WaitIdle()
+	clock.Advance(350 * time.Millisecond)
+	sch.WaitIdle()
+	clock.Advance(250 * time.Millisecond)
+	sch.WaitIdle()
+
+	lgr.mu.Lock()
+	defer lgr.mu.Unlock()
+	if runs != 6 || len(lgr.missed) != 2 || lgr.missed[0] != 3 || lgr.missed[1] != 3 {
+		t.Error("wrong misfires. expected: 6 runs, [3 3], actual:", runs, lgr.missed)
+	}
+}
+
+func TestMisfireSkip(t *testing.T) {
+	runs, missed, status := testMisfire(t, MisfireSkip, 0)
+	if runs != 0 {
+		t.Error("the missed activations should be skipped. actual runs:", runs)
+	}
+	if len(missed) != 1 || missed[0] != 4 {
+		t.Error("wrong missed activations. expected: [4], actual:", missed)
+	}
+	if !strings.HasPrefix(status.Status, "skipped: misfired") {
+		t.Error("wrong status:", status.Status)
+	}
+	if d := status.NextUpdate.Sub(misfireStart); d <= 0 || d > 100*time.Millisecond {
+		t.Error("the task should be scheduled on the next activation:", status.NextUpdate)
+	}
+}
+
+func TestMisfireSkipIfLate(t *testing.T) {
+	if runs, _, _ := testMisfire(t, MisfireSkipIfLate, 500*time.Millisecond); runs != 1 {
+		t.Error("the task late within the threshold should run. actual runs:", runs)
+	}
+	if runs, _, _ := testMisfire(t, MisfireSkipIfLate, 200*time.Millisecond); runs != 0 {
+		t.Error("the task late beyond the threshold should be skipped. actual runs:", runs)
+	}
+}
@@ -0,0 +1,177 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"container/heap"
+	"time"
+)
+
+// taskQueue is a min-heap of tasks ordered by the time they are due, then by
+// priority, then by the order they are added.  It implements heap.Interface.
+type taskQueue []*Task
+
+func (q taskQueue) Len() int {
+	return len(q)
+}
+
+func (q taskQueue) Less(i, j int) bool {
+	return q[i].before(q[j])
+}
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	task := x.(*Task)
+	task.index = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	*q = old[:n-1]
+	return task
+}
+
+// before tells if the task is ordered before the other one in the queue.
+func (task *Task) before(other *Task) bool {
+	if !task.due.Equal(other.due) {
+		return task.due.Before(other.due)
+	}
+	if task.Priority != other.Priority {
+		return task.Priority > other.Priority
+	}
+	return task.seq < other.seq
+}
+
+// peek returns the task due first, or nil if the queue is empty.
+func (q taskQueue) peek() *Task {
+	if len(q) == 0 {
+		return nil
+	}
+	return q[0]
+}
+
+// schedule puts the task into the queue, or moves it if it is queued already.
+// Triggered tasks are due when they are triggered.  Paused tasks are not
+// queued.  Disabled tasks are due when their TTL passes, and are not queued at
+// all if there is no TTL.
+func (q *taskQueue) schedule(task *Task, ttl time.Duration) {
+	if task.ready {
+		heap.Remove(&task.bj4.ready, task.index)
+	}
+	if !task.trigger.IsZero() {
+		task.due = task.trigger
+	} else if task.Paused {
+		q.remove(task)
+		return
+	} else if task.Disabled {
+		if ttl <= 0 {
+			q.remove(task)
+			return
+		}
+		task.due = task.Completed.Add(ttl)
+	} else {
+		task.due = task.NextUpdate
+	}
+
+	if task.index >= 0 {
+		heap.Fix(q, task.index)
+	} else {
+		heap.Push(q, task)
+	}
+}
+
+// remove takes the task out of the queue if it is queued.
+func (q *taskQueue) remove(task *Task) {
+	if task.ready {
+		heap.Remove(&task.bj4.ready, task.index)
+	} else if task.index >= 0 {
+		heap.Remove(q, task.index)
+	}
+}
+
+// readyQueue is a heap of the due tasks ordered by priority, then by the order
+// in taskQueue.  With aging, a task of a higher priority is ordered as if it
+// was due earlier by AgingThreshold for each priority, which is to promote a
+// task by one priority for every AgingThreshold it has been overdue.  The order
+// does not change over time, so that aging needs no rekeying.  It implements
+// heap.Interface.
+type readyQueue []*Task
+
+func (q readyQueue) Len() int {
+	return len(q)
+}
+
+func (q readyQueue) Less(i, j int) bool {
+	ti, tj := q[i], q[j]
+	if aging := ti.bj4.agingThreshold; aging > 0 {
+		ri := ti.due.Add(-time.Duration(ti.Priority) * aging)
+		rj := tj.due.Add(-time.Duration(tj.Priority) * aging)
+		if !ri.Equal(rj) {
+			return ri.Before(rj)
+		}
+	} else if ti.Priority != tj.Priority {
+		return ti.Priority > tj.Priority
+	}
+	return ti.before(tj)
+}
+
+func (q readyQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *readyQueue) Push(x interface{}) {
+	task := x.(*Task)
+	task.index = len(*q)
+	task.ready = true
+	*q = append(*q, task)
+}
+
+func (q *readyQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	task.ready = false
+	*q = old[:n-1]
+	return task
+}
@@ -0,0 +1,172 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"container/heap"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newBenchmarkScheduler(n int) *BJ4 {
+	sch := New(&Config{})
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		task := &Task{
+			TaskStatus: TaskStatus{
+				Name:       strconv.Itoa(i),
+				NextUpdate: now.Add(time.Hour + time.Duration(rand.Int63n(int64(time.Hour)))),
+			},
+			bj4:   sch,
+			index: -1,
+		}
+		sch.enqueueTask(task)
+	}
+	return sch
+}
+
+func TestTaskQueue(t *testing.T) {
+	sch := newBenchmarkScheduler(1000)
+
+	sch.removeTask("10")
+	sch.removeTask("20")
+	if sch.queue.Len() != 998 || len(sch.tasks) != 998 {
+		t.Fatal("wrong number of queued tasks:", sch.queue.Len(), len(sch.tasks))
+	}
+
+	task := sch.tasks["30"]
+	task.NextUpdate = time.Now()
+	sch.queue.schedule(task, 0)
+	if sch.queue.peek() != task {
+		t.Error("rescheduled task is not due first")
+	}
+
+	var last time.Time
+	for sch.queue.Len() > 0 {
+		task := heap.Pop(&sch.queue).(*Task)
+		if task.due.Before(last) {
+			t.Fatal("tasks are not popped in order of due time")
+		}
+		last = task.due
+	}
+}
+
+func TestReadyQueue(t *testing.T) {
+	sch := New(&Config{AgingThreshold: time.Minute})
+	now := time.Now()
+	tasks := make(map[string]*Task)
+	for i, task := range []struct {
+		name     string
+		due      time.Duration
+		priority int
+	}{
+		{"a", -90 * time.Second, 0},
+		{"b", -20 * time.Second, 1},
+		{"c", 0, 2},
+		{"d", -80 * time.Second, 0},
+		{"e", -10 * time.Second, 0},
+	} {
+		tasks[task.name] = &Task{
+			TaskStatus: TaskStatus{Name: task.name, Priority: task.priority},
+			bj4:        sch,
+			due:        now.Add(task.due),
+			seq:        uint64(i),
+		}
+		heap.Push(&sch.ready, tasks[task.name])
+	}
+
+	// a task leaves the ready queue once rescheduled or removed
+	task := tasks["c"]
+	if sch.ready[0] != task {
+		t.Fatal("task of the highest priority is not ready first")
+	}
+	task.NextUpdate = now.Add(time.Hour)
+	sch.queue.schedule(task, 0)
+	if task.ready || sch.queue.peek() != task {
+		t.Error("rescheduled task is not queued")
+	}
+	sch.queue.remove(tasks["e"])
+	if tasks["e"].ready || tasks["e"].index != -1 {
+		t.Error("removed task is still ready")
+	}
+
+	// b is promoted by aging as much as d, and d is due earlier
+	var names []string
+	for sch.ready.Len() > 0 {
+		names = append(names, heap.Pop(&sch.ready).(*Task).Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "d", "b"}) {
+		t.Error("wrong order:", names)
+	}
+}
+
+// BenchmarkWakeUp100k measures a wake-up of the scheduler with nothing due
+// among 100k tasks.
+func BenchmarkWakeUp100k(b *testing.B) {
+	sch := newBenchmarkScheduler(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sch.run()
+		sch.getWaitTime()
+	}
+}
+
+// BenchmarkReschedule100k measures rescheduling a task among 100k tasks.
+func BenchmarkReschedule100k(b *testing.B) {
+	sch := newBenchmarkScheduler(100000)
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		task := sch.tasks[strconv.Itoa(i%100000)]
+		task.NextUpdate = now.Add(time.Hour + time.Duration(rand.Int63n(int64(time.Hour))))
+		sch.queue.schedule(task, 0)
+	}
+}
+
+// BenchmarkAddRemove100k measures adding and removing a task among 100k tasks.
+func BenchmarkAddRemove100k(b *testing.B) {
+	sch := newBenchmarkScheduler(100000)
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sch.enqueueTask(&Task{
+			TaskStatus: TaskStatus{
+				Name:       "bench",
+				NextUpdate: now.Add(time.Duration(rand.Int63n(int64(2 * time.Hour)))),
+			},
+			bj4:   sch,
+			index: -1,
+		})
+		sch.removeTask("bench")
+	}
+}
@@ -0,0 +1,127 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const defaultRetryDelay = time.Second
+
+// Jitter decides how a retry delay is randomized.
+type Jitter int
+
+const (
+	// NoJitter uses the retry delay as is.
+	NoJitter Jitter = iota
+	// FullJitter picks a random delay between zero and the retry delay.
+	FullJitter
+	// EqualJitter keeps half of the retry delay, and picks the other half
+	// randomly between zero and half of the retry delay.
+	EqualJitter
+)
+
+// RetryPolicy decides how failed runs of a task are retried.  The delay before
+// the n-th retry is InitialDelay * Multiplier^(n-1), capped at MaxDelay and
+// then randomized by Jitter.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of runs, including the first one.
+	// If not set, failed runs are retried until they succeed.
+	MaxAttempts int
+	// InitialDelay is the delay before the first retry.  If not set, 1
+	// second is used.
+	InitialDelay time.Duration
+	// Multiplier is the factor the delay grows by for every retry.  If not
+	// set, 2 is used.
+	Multiplier float64
+	// MaxDelay caps the delay.  If not set, the delay is not capped.
+	MaxDelay time.Duration
+	// Jitter decides how the delay is randomized.
+	Jitter Jitter
+	// Retryable decides if a run failed with err should be retried.  If
+	// nil, all errors are retried.
+	Retryable func(err error) bool
+}
+
+// WithRetry retries failed runs of the task with the policy.  Errors, timeouts
+// and panics are all considered failures.  While a run is being retried, the
+// error channel of the task receives nothing, and the nextUpdate returned by
+// the task function is ignored.
+func WithRetry(policy RetryPolicy) TaskOption {
+	return func(task *Task) {
+		task.retry = &policy
+	}
+}
+
+func (policy *RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if policy == nil {
+		return false
+	}
+	if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+		return false
+	}
+	return policy.Retryable == nil || policy.Retryable(err)
+}
+
+// delay computes the delay after the given attempt fails.
+func (policy *RetryPolicy) delay(attempt int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	initialDelay := policy.InitialDelay
+	if initialDelay <= 0 {
+		initialDelay = defaultRetryDelay
+	}
+
+	d := float64(initialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if policy.MaxDelay > 0 && d > float64(policy.MaxDelay) {
+		d = float64(policy.MaxDelay)
+	}
+	// float64(math.MaxInt64) is 2^63, which overflows a Duration
+	delay := time.Duration(math.MaxInt64)
+	if d < float64(math.MaxInt64) {
+		delay = time.Duration(d)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	switch policy.Jitter {
+	case FullJitter:
+		delay = time.Duration(rand.Int63n(int64(delay)))
+	case EqualJitter:
+		half := delay / 2
+		delay = half + time.Duration(rand.Int63n(int64(delay-half)))
+	}
+	return delay
+}
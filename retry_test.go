@@ -0,0 +1,109 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := &RetryPolicy{
+		InitialDelay: 100 * time.Millisecond,
+		Multiplier:   3,
+		MaxDelay:     time.Second,
+	}
+	for attempt, expected := range []time.Duration{
+		1: 100 * time.Millisecond,
+		2: 300 * time.Millisecond,
+		3: 900 * time.Millisecond,
+		4: time.Second,
+		5: time.Second,
+	} {
+		if attempt == 0 {
+			continue
+		}
+		if d := policy.delay(attempt); d != expected {
+			t.Error("wrong delay after attempt", attempt, ". expected:", expected, ", actual:", d)
+		}
+	}
+
+	// the delay saturates instead of overflowing without MaxDelay
+	unbounded := &RetryPolicy{InitialDelay: time.Second}
+	for _, attempt := range []int{35, 64, 100, 10000} {
+		if d := unbounded.delay(attempt); d != time.Duration(math.MaxInt64) {
+			t.Error("wrong delay after attempt", attempt, ":", d)
+		}
+	}
+
+	// the zero value retries after 1 second, doubled every time
+	var zero RetryPolicy
+	for attempt, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second} {
+		if d := zero.delay(attempt); d != expected {
+			t.Error("wrong default delay after attempt", attempt, ". expected:", expected, ", actual:", d)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		policy.Jitter = FullJitter
+		if d := policy.delay(3); d < 0 || d >= 900*time.Millisecond {
+			t.Fatal("full jitter out of range:", d)
+		}
+		policy.Jitter = EqualJitter
+		if d := policy.delay(3); d < 450*time.Millisecond || d >= 900*time.Millisecond {
+			t.Fatal("equal jitter out of range:", d)
+		}
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	errFatal := errors.New("fatal")
+	policy := &RetryPolicy{
+		MaxAttempts: 3,
+		Retryable: func(err error) bool {
+			return err != errFatal
+		},
+	}
+
+	if !policy.shouldRetry(2, errors.New("oops")) {
+		t.Error("attempt 2 should be retried")
+	}
+	if policy.shouldRetry(3, errors.New("oops")) {
+		t.Error("attempt 3 should not be retried")
+	}
+	if policy.shouldRetry(1, errFatal) {
+		t.Error("fatal error should not be retried")
+	}
+	if (*RetryPolicy)(nil).shouldRetry(1, errors.New("oops")) {
+		t.Error("task without policy should not be retried")
+	}
+}
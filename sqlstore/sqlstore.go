@@ -0,0 +1,364 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package sqlstore provides a bj4.HistoryStore backed by database/sql, so
+// that the state of tasks can be queried along with other operational data.
+//
+// The schema is created and migrated by New.  The statuses of tasks are kept
+// in the table bj4_tasks, indexed by the next update time so that the
+// scheduler only loads the tasks due soon when it starts, and the records of
+// runs are kept in the table bj4_runs.  The driver is not imported by this
+// package; import a driver such as modernc.org/sqlite or
+// github.com/jackc/pgx/v5/stdlib, and pass the matching Dialect.
+package sqlstore
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+)
+
+const defaultHistoryLimit = 100
+
+// Dialect describes the SQL dialect of a database.
+type Dialect struct {
+	name       string
+	numbered   bool
+	migrations []string
+}
+
+var (
+	// SQLite is the dialect of SQLite, e.g. with the pure-Go driver
+	// modernc.org/sqlite.
+	SQLite = &Dialect{
+		name: "sqlite",
+		migrations: []string{
+			`CREATE TABLE bj4_tasks (
+				name TEXT PRIMARY KEY,
+				status TEXT NOT NULL,
+				next_update TIMESTAMP,
+				completed TIMESTAMP,
+				started TIMESTAMP,
+				disabled BOOLEAN NOT NULL,
+				priority INTEGER NOT NULL,
+				attempt INTEGER NOT NULL,
+				retrying BOOLEAN NOT NULL
+			);
+			CREATE INDEX bj4_tasks_next_update ON bj4_tasks (next_update);
+			CREATE TABLE bj4_runs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				started TIMESTAMP,
+				finished TIMESTAMP,
+				attempt INTEGER NOT NULL,
+				status TEXT NOT NULL,
+				error TEXT NOT NULL
+			);
+			CREATE INDEX bj4_runs_name ON bj4_runs (name, id)`,
+			`ALTER TABLE bj4_tasks ADD COLUMN paused BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	}
+
+	// Postgres is the dialect of PostgreSQL.
+	Postgres = &Dialect{
+		name:     "postgres",
+		numbered: true,
+		migrations: []string{
+			`CREATE TABLE bj4_tasks (
+				name TEXT PRIMARY KEY,
+				status TEXT NOT NULL,
+				next_update TIMESTAMPTZ,
+				completed TIMESTAMPTZ,
+				started TIMESTAMPTZ,
+				disabled BOOLEAN NOT NULL,
+				priority INTEGER NOT NULL,
+				attempt INTEGER NOT NULL,
+				retrying BOOLEAN NOT NULL
+			);
+			CREATE INDEX bj4_tasks_next_update ON bj4_tasks (next_update);
+			CREATE TABLE bj4_runs (
+				id BIGSERIAL PRIMARY KEY,
+				name TEXT NOT NULL,
+				started TIMESTAMPTZ,
+				finished TIMESTAMPTZ,
+				attempt INTEGER NOT NULL,
+				status TEXT NOT NULL,
+				error TEXT NOT NULL
+			);
+			CREATE INDEX bj4_runs_name ON bj4_runs (name, id)`,
+			`ALTER TABLE bj4_tasks ADD COLUMN paused BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	}
+)
+
+// rebind replaces the ? placeholders in query with the ones of the dialect.
+func (d *Dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Options configures the Store.
+type Options struct {
+	// HistoryLimit is the number of run records kept for each task.  Older
+	// records are removed as new ones are saved.  The default is 100.
+	HistoryLimit int
+}
+
+// Store implements bj4.HistoryStore and bj4.DueStore with database/sql.
+type Store struct {
+	db      *sql.DB
+	dialect *Dialect
+	opts    Options
+}
+
+const taskColumns = "name, status, next_update, completed, started, disabled, priority, attempt, retrying, paused"
+
+// New creates a Store on db, and migrates the schema to the latest version.
+// opts can be nil for the defaults.
+func New(db *sql.DB, dialect *Dialect, opts *Options) (*Store, error) {
+	s := &Store{db: db, dialect: dialect}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.HistoryLimit <= 0 {
+		s.opts.HistoryLimit = defaultHistoryLimit
+	}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the migrations which have not been applied, each in its
+// own transaction.
+func (s *Store) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS bj4_migrations (version INTEGER PRIMARY KEY)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM bj4_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(s.dialect.migrations); i++ {
+		err := s.transact(func(tx *sql.Tx) error {
+			for _, stmt := range strings.Split(s.dialect.migrations[i], ";") {
+				if strings.TrimSpace(stmt) == "" {
+					continue
+				}
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(s.dialect.rebind(`INSERT INTO bj4_migrations (version) VALUES (?)`), i+1)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load returns the stored statuses sorted by name.
+func (s *Store) Load() ([]bj4.TaskStatus, error) {
+	return s.query(`SELECT ` + taskColumns + ` FROM bj4_tasks ORDER BY name`)
+}
+
+// LoadDue returns the statuses of the enabled and unpaused tasks due before t,
+// sorted by their next update time.  It uses the index on the next update
+// time, so that the scheduler only loads the tasks due soon when it starts.
+func (s *Store) LoadDue(t time.Time) ([]bj4.TaskStatus, error) {
+	return s.query(`SELECT `+taskColumns+` FROM bj4_tasks
+		WHERE next_update IS NOT NULL AND next_update < ? AND NOT disabled AND NOT paused
+		ORDER BY next_update, name`, t.UTC())
+}
+
+// LoadTask returns the status of a task, or false if it is not stored.
+func (s *Store) LoadTask(name string) (bj4.TaskStatus, bool, error) {
+	statuses, err := s.query(`SELECT `+taskColumns+` FROM bj4_tasks WHERE name = ?`, name)
+	if err != nil || len(statuses) == 0 {
+		return bj4.TaskStatus{}, false, err
+	}
+	return statuses[0], true, nil
+}
+
+func (s *Store) query(query string, args ...interface{}) ([]bj4.TaskStatus, error) {
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []bj4.TaskStatus
+	for rows.Next() {
+		var status bj4.TaskStatus
+		var nextUpdate, completed, started sql.NullTime
+		err := rows.Scan(&status.Name, &status.Status, &nextUpdate, &completed, &started,
+			&status.Disabled, &status.Priority, &status.Attempt, &status.Retrying, &status.Paused)
+		if err != nil {
+			return nil, err
+		}
+		status.NextUpdate = fromNullTime(nextUpdate)
+		status.Completed = fromNullTime(completed)
+		status.Started = fromNullTime(started)
+		statuses = append(statuses, status)
+	}
+	return statuses, rows.Err()
+}
+
+// Save stores the status of a task.
+func (s *Store) Save(status bj4.TaskStatus) error {
+	_, err := s.db.Exec(s.dialect.rebind(upsertTask), taskArgs(status)...)
+	return err
+}
+
+// SaveRun stores the status of a task and the record of its run in a single
+// transaction.
+func (s *Store) SaveRun(status bj4.TaskStatus, record bj4.RunRecord) error {
+	return s.transact(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(s.dialect.rebind(upsertTask), taskArgs(status)...); err != nil {
+			return err
+		}
+		_, err := tx.Exec(s.dialect.rebind(`INSERT INTO bj4_runs
+			(name, started, finished, attempt, status, error) VALUES (?, ?, ?, ?, ?, ?)`),
+			status.Name, toNullTime(record.Started), toNullTime(record.Finished),
+			record.Attempt, record.Status, record.Error)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(s.dialect.rebind(`DELETE FROM bj4_runs WHERE name = ? AND id NOT IN
+			(SELECT id FROM bj4_runs WHERE name = ? ORDER BY id DESC LIMIT ?)`),
+			status.Name, status.Name, s.opts.HistoryLimit)
+		return err
+	})
+}
+
+// History returns at most limit records of the latest runs of a task, the
+// latest first.
+func (s *Store) History(name string, limit int) ([]bj4.RunRecord, error) {
+	rows, err := s.db.Query(s.dialect.rebind(`SELECT started, finished, attempt, status, error
+		FROM bj4_runs WHERE name = ? ORDER BY id DESC LIMIT ?`), name, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []bj4.RunRecord
+	for rows.Next() {
+		var record bj4.RunRecord
+		var started, finished sql.NullTime
+		err := rows.Scan(&started, &finished, &record.Attempt, &record.Status, &record.Error)
+		if err != nil {
+			return nil, err
+		}
+		record.Started = fromNullTime(started)
+		record.Finished = fromNullTime(finished)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Delete removes the status and the history of a task.
+func (s *Store) Delete(name string) error {
+	return s.transact(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(s.dialect.rebind(`DELETE FROM bj4_runs WHERE name = ?`), name); err != nil {
+			return err
+		}
+		_, err := tx.Exec(s.dialect.rebind(`DELETE FROM bj4_tasks WHERE name = ?`), name)
+		return err
+	})
+}
+
+func (s *Store) transact(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const upsertTask = `INSERT INTO bj4_tasks (` + taskColumns + `)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (name) DO UPDATE SET
+		status = excluded.status,
+		next_update = excluded.next_update,
+		completed = excluded.completed,
+		started = excluded.started,
+		disabled = excluded.disabled,
+		priority = excluded.priority,
+		attempt = excluded.attempt,
+		retrying = excluded.retrying,
+		paused = excluded.paused`
+
+func taskArgs(status bj4.TaskStatus) []interface{} {
+	return []interface{}{
+		status.Name, status.Status,
+		toNullTime(status.NextUpdate), toNullTime(status.Completed), toNullTime(status.Started),
+		status.Disabled, status.Priority, status.Attempt, status.Retrying, status.Paused,
+	}
+}
+
+// toNullTime stores zero time as NULL, and other times in UTC so that they
+// compare correctly in databases keeping times as text.
+func toNullTime(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+func fromNullTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time
+}
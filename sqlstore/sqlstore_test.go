@@ -0,0 +1,177 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	bj4 "github.com/rayark/go-bj4"
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T, path string, opts *Options) *Store {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	s, err := New(db, SQLite, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bj4.db")
+	s := openSQLite(t, path, &Options{HistoryLimit: 3})
+
+	now := time.Now().UTC()
+	statuses := []bj4.TaskStatus{
+		{Name: "1", Status: "retrying: oops", NextUpdate: now.Add(time.Minute), Attempt: 2, Retrying: true},
+		{Name: "2", Status: "completed: done", Completed: now, Disabled: true, Priority: 5},
+		{Name: "3", Status: "added", NextUpdate: now.Add(time.Hour), Started: now},
+		{Name: "4", Status: "added", NextUpdate: now.Add(time.Minute), Paused: true},
+	}
+	for _, status := range statuses {
+		if err := s.Save(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 5; i++ {
+		err := s.SaveRun(statuses[0], bj4.RunRecord{Started: now, Finished: now, Attempt: i, Status: "run " + strconv.Itoa(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// migrating again does nothing
+	s = openSQLite(t, path, &Options{HistoryLimit: 3})
+
+	loaded, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, statuses) {
+		t.Error("wrong statuses. expected:", statuses, ", actual:", loaded)
+	}
+
+	due, err := s.LoadDue(now.Add(10 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || due[0].Name != "1" {
+		t.Error("wrong due tasks:", due)
+	}
+
+	records, err := s.History("1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seq []string
+	for _, record := range records {
+		seq = append(seq, record.Status)
+	}
+	if !reflect.DeepEqual(seq, []string{"run 5", "run 4", "run 3"}) {
+		t.Error("wrong history:", seq)
+	}
+
+	if err := s.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ = s.Load()
+	records, _ = s.History("1", 10)
+	if len(loaded) != 3 || len(records) != 0 {
+		t.Error("task is not deleted:", loaded, records)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT a FROM t WHERE b = ? AND c < ? LIMIT ?`
+	if q := SQLite.rebind(query); q != query {
+		t.Error("wrong query for sqlite:", q)
+	}
+	expected := `SELECT a FROM t WHERE b = $1 AND c < $2 LIMIT $3`
+	if q := Postgres.rebind(query); q != expected {
+		t.Error("wrong query for postgres:", q)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := openSQLite(t, filepath.Join(t.TempDir(), "bj4.db"), nil)
+
+	sch := bj4.New(&bj4.Config{Store: s})
+	go sch.Start()
+	errChan := sch.SetTask("1", func(task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		result = "done"
+		nextUpdate = time.Now().Add(2 * time.Hour)
+		return
+	})
+	<-errChan
+	sch.Stop()
+
+	records, err := s.History("1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Status != "completed: done" || records[0].Attempt != 1 {
+		t.Error("wrong history:", records)
+	}
+	due, _ := s.LoadDue(time.Now().Add(3 * time.Hour))
+	if len(due) != 1 || due[0].Status != "completed: done" {
+		t.Error("wrong status:", due)
+	}
+
+	// the task is not due within MinWaitTime, and is looked up once
+	// registered
+	sch = bj4.New(&bj4.Config{Store: s})
+	go sch.Start()
+	defer sch.Stop()
+	sch.Register("1", func(ctx context.Context, task *bj4.Task) (result string, nextUpdate time.Time, err error) {
+		t.Error("restored task should not run")
+		return
+	})
+	sch.WaitIdle()
+	status, err := sch.GetTask("1")
+	if err != nil || status.Status != "completed: done" || !status.NextUpdate.Equal(due[0].NextUpdate) {
+		t.Error("task is not restored:", status, err)
+	}
+	if _, ok, err := s.LoadTask("2"); ok || err != nil {
+		t.Error("task not stored should not be found:", ok, err)
+	}
+}
@@ -0,0 +1,185 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import "time"
+
+// Store is an interface for bj4 to persist the status of tasks, so that the
+// schedule survives restarts.
+type Store interface {
+	// Load returns the statuses of all stored tasks.
+	Load() ([]TaskStatus, error)
+
+	// Save stores the status of a task, replacing the stored status of
+	// the same name.
+	Save(status TaskStatus) error
+
+	// Delete removes the status of a task.  Deleting a task which is not
+	// stored is not an error.
+	Delete(name string) error
+}
+
+// RunRecord describes a finished run of a task.
+type RunRecord struct {
+	Started  time.Time
+	Finished time.Time
+	Attempt  int
+	// Status is the status of the task right after the run.
+	Status string
+	// Error is the message of the error the run failed with, or empty if
+	// the run succeeded.
+	Error string
+}
+
+// HistoryStore is a Store which keeps the history of runs as well.
+type HistoryStore interface {
+	Store
+
+	// SaveRun stores the status of a task together with the record of the
+	// run which has just finished.  Both are saved atomically.
+	SaveRun(status TaskStatus, record RunRecord) error
+
+	// History returns at most limit records of the latest runs of a task,
+	// the latest first.
+	History(name string, limit int) ([]RunRecord, error)
+}
+
+// DueStore is a Store which can load the statuses of the tasks due soon
+// without loading all of them, e.g. with an index on the next update time.
+// The scheduler then loads the statuses due within MinWaitTime when it starts,
+// and looks up the others one by one as the tasks are registered.
+type DueStore interface {
+	Store
+
+	// LoadDue returns the statuses of the tasks due before t.  Disabled and
+	// paused tasks may be left out.
+	LoadDue(t time.Time) ([]TaskStatus, error)
+
+	// LoadTask returns the status of a task, or false if it is not stored.
+	LoadTask(name string) (status TaskStatus, ok bool, err error)
+}
+
+func (bj4 *BJ4) loadStore() error {
+	bj4.stored = make(map[string]TaskStatus)
+	bj4.restored = make(map[string]bool)
+	if bj4.store == nil {
+		return nil
+	}
+	var statuses []TaskStatus
+	var err error
+	if store, ok := bj4.store.(DueStore); ok {
+		statuses, err = store.LoadDue(bj4.clock.Now().Add(bj4.minWaitTime))
+	} else {
+		statuses, err = bj4.store.Load()
+	}
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		bj4.stored[status.Name] = status
+	}
+	return nil
+}
+
+// restoreTask continues the task from its stored status.  A status is
+// restored at most once after the scheduler starts.
+//
+// A task stored as running was interrupted by a crash.  Its next update time
+// has not been moved by the interrupted run, so it runs again as soon as
+// possible, as the same attempt.
+func (bj4 *BJ4) restoreTask(task *Task) {
+	if bj4.restored[task.Name] {
+		return
+	}
+	bj4.restored[task.Name] = true
+
+	status, ok := bj4.stored[task.Name]
+	delete(bj4.stored, task.Name)
+	if store, isDue := bj4.store.(DueStore); !ok && isDue {
+		var err error
+		if status, ok, err = store.LoadTask(task.Name); err != nil {
+			bj4.logger.OnStoreError(task, err)
+		}
+	}
+	if !ok {
+		return
+	}
+
+	task.Status = status.Status
+	task.NextUpdate = status.NextUpdate
+	task.Completed = status.Completed
+	task.Disabled = status.Disabled
+	task.Started = status.Started
+	task.Attempt = status.Attempt
+	task.Retrying = status.Retrying
+	task.Paused = status.Paused
+
+	if status.Status == statusRunning {
+		task.Status = statusInterrupted
+		if task.Attempt > 1 {
+			// run the interrupted attempt again
+			task.Attempt--
+			task.Retrying = true
+		}
+		bj4.saveRun(task, RunRecord{
+			Started: status.Started,
+			Attempt: status.Attempt,
+			Status:  statusInterrupted,
+			Error:   "interrupted",
+		})
+	}
+}
+
+const (
+	statusInterrupted = "interrupted"
+	statusAbandoned   = "abandoned"
+)
+
+// saveRun saves the task and the record of its run if the Store keeps the
+// history of runs, or saves the task only if not.
+func (bj4 *BJ4) saveRun(task *Task, record RunRecord) {
+	store, ok := bj4.store.(HistoryStore)
+	if !ok {
+		bj4.saveTask(task)
+		return
+	}
+	if err := store.SaveRun(task.Snapshot(), record); err != nil {
+		bj4.logger.OnStoreError(task, err)
+	}
+}
+
+func (bj4 *BJ4) saveTask(task *Task) {
+	if bj4.store == nil {
+		return
+	}
+	if err := bj4.store.Save(task.Snapshot()); err != nil {
+		bj4.logger.OnStoreError(task, err)
+	}
+}
@@ -0,0 +1,210 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileStore implements Store and keeps the statuses in a file.  Every change
+// is appended to the file as a line of JSON, and the file is compacted into
+// one line per task when it is loaded.  The last line left incomplete by a
+// crash is ignored, but Load fails if any other line is corrupt, leaving the
+// file as it is.
+type FileStore struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+type fileStoreRecord struct {
+	Status *TaskStatus `json:",omitempty"`
+	Delete string      `json:",omitempty"`
+}
+
+// NewFileStore creates a FileStore keeping the statuses in the file at path.
+// The file is created when it is written for the first time.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load returns the stored statuses sorted by name, and compacts the file.
+func (s *FileStore) Load() ([]TaskStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.compact(statuses); err != nil {
+		return nil, err
+	}
+
+	result := make([]TaskStatus, 0, len(statuses))
+	for _, status := range statuses {
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func (s *FileStore) Save(status TaskStatus) error {
+	return s.append(fileStoreRecord{Status: &status})
+}
+
+func (s *FileStore) Delete(name string) error {
+	return s.append(fileStoreRecord{Delete: name})
+}
+
+// Close closes the file.  The FileStore can still be used afterwards, and
+// the file is opened again when needed.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *FileStore) read() (map[string]TaskStatus, error) {
+	statuses := make(map[string]TaskStatus)
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return statuses, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	var corrupt error
+	for line := 1; scanner.Scan(); line++ {
+		if corrupt != nil {
+			// only the last line can be left incomplete by a crash
+			return nil, corrupt
+		}
+		var record fileStoreRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			corrupt = fmt.Errorf("bj4: corrupt line %d in %s: %v", line, s.path, err)
+			continue
+		}
+		switch {
+		case record.Status != nil:
+			statuses[record.Status.Name] = *record.Status
+		case record.Delete != "":
+			delete(statuses, record.Delete)
+		}
+	}
+	return statuses, scanner.Err()
+}
+
+// compact replaces the file with one holding a line per task, and keeps it
+// open for appending.
+func (s *FileStore) compact(statuses map[string]TaskStatus) error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, status := range statuses {
+		status := status
+		if err = enc.Encode(fileStoreRecord{Status: &status}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileStore) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+func (s *FileStore) append(record fileStoreRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
@@ -0,0 +1,193 @@
+/* Copyright (c) 2017, Rayark Inc.
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ * * Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ * * Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ * * Neither the name of the copyright holder nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bj4
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, store Store) {
+	now := time.Now().Truncate(time.Second).UTC()
+	statuses := []TaskStatus{
+		{Name: "1", Status: "added", NextUpdate: now},
+		{Name: "2", Status: "completed: done", Completed: now, Disabled: true},
+		{Name: "3", Status: "retrying: oops", NextUpdate: now, Attempt: 2, Retrying: true},
+	}
+	for _, status := range statuses {
+		if err := store.Save(status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses[0].Status = "running"
+	if err := store.Save(statuses[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("4"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TaskStatus{statuses[0], statuses[2]}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Error("wrong statuses. expected:", expected, ", actual:", loaded)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.wal")
+	store := NewFileStore(path)
+	testStore(t, store)
+	store.Close()
+
+	// a line left incomplete by a crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Status":{"Name":"4","Sta`)
+	f.Close()
+
+	store = NewFileStore(path)
+	defer store.Close()
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || loaded[0].Name != "1" || loaded[1].Name != "3" {
+		t.Error("wrong statuses after reopening:", loaded)
+	}
+
+	// the file is compacted into a line per task
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for _, c := range data {
+		if c == '\n' {
+			lines++
+		}
+	}
+	if lines != 2 {
+		t.Error("file is not compacted, lines:", lines)
+	}
+	store.Close()
+
+	// a corrupt line followed by others is not ignored
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Status":{"Name":"4","Sta` + "\n" + `{"Delete":"1"}` + "\n")
+	f.Close()
+	corrupt, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store = NewFileStore(path)
+	if _, err := store.Load(); err == nil {
+		t.Error("expected error on a corrupt line")
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(corrupt) {
+		t.Error("file with a corrupt line should be left as it is")
+	}
+}
+
+func TestRestoreFromStore(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	store.Save(TaskStatus{Name: "1", NextUpdate: now.Add(100 * time.Millisecond), Completed: now.Add(-time.Hour)})
+	store.Save(TaskStatus{Name: "2", Completed: now.Add(-time.Hour), Disabled: true})
+	store.Save(TaskStatus{Name: "4", NextUpdate: now, Paused: true})
+
+	var seq []string
+	sch := New(&Config{Store: store, Clock: clock})
+	go sch.Start()
+
+	fn := func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error) {
+		seq = append(seq, task.Name)
+		nextUpdate = clock.Now().Add(time.Hour)
+		return
+	}
+	errChan := sch.Register("1", fn)
+	sch.Register("2", fn)
+	sch.Register("3", fn)
+	sch.Register("4", fn)
+
+	// 1 runs at the stored next update time
+	sch.WaitIdle()
+	clock.Advance(100*time.Millisecond - 1)
+	sch.WaitIdle()
+	select {
+	case <-errChan:
+		t.Fatal("restored task should not run before its next update time")
+	default:
+	}
+	clock.Advance(1)
+	<-errChan
+	sch.Stop()
+
+	if !reflect.DeepEqual(seq, []string{"3", "1"}) {
+		t.Error("wrong sequence:", seq)
+	}
+
+	statuses, _ := store.Load()
+	if len(statuses) != 4 {
+		t.Fatal("wrong number of stored statuses:", len(statuses))
+	}
+	for _, status := range statuses {
+		if status.Name == "4" {
+			if !status.Paused {
+				t.Error("paused task is not restored paused:", status)
+			}
+			continue
+		}
+		if status.Name != "2" && (status.Status != "completed: " || status.NextUpdate.Before(now.Add(time.Minute))) {
+			t.Error("status is not saved after run:", status)
+		}
+	}
+}
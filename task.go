@@ -30,7 +30,10 @@
 package bj4
 
 import (
+	"context"
 	"fmt"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
@@ -38,8 +41,54 @@ import (
 type Task struct {
 	TaskStatus
 	bj4       *BJ4
-	function  TaskFunction
+	function  ContextTaskFunction
+	schedule  Schedule
+	timeout   time.Duration
+	retry     *RetryPolicy
 	errorChan chan error
+	token     uint64
+
+	misfire          MisfirePolicy
+	misfireThreshold time.Duration
+	// catchingUp tells that the task is running for the activations it
+	// missed under MisfireCatchUp, which is reported once.
+	catchingUp bool
+
+	// interval is the time from the completion of the last run to the next
+	// update time it returned, which a task without a schedule keeps to if a
+	// run panics or times out.
+	interval time.Duration
+
+	// trigger is the time TriggerTask is called, and triggered tells that
+	// the current run is triggered.  reschedule is the time RescheduleTask
+	// moves the running task to once the run is done.
+	trigger    time.Time
+	triggered  bool
+	reschedule time.Time
+
+	// waiters wait for the next triggered or scheduled run, and runWaiters
+	// wait for the current run.
+	waiters    []runWaiter
+	runWaiters []chan error
+
+	// history is the records of the latest runs, the latest last.
+	history []RunRecord
+
+	// mu guards TaskStatus while the task runs, when SetStatus may write it
+	// from the goroutine of the run.  live tells that the run is not done.
+	mu   sync.Mutex
+	live bool
+	// runs counts the runs, so that the result of a run abandoned by
+	// Shutdown is not taken for the result of a later run.
+	runs uint64
+
+	// index is the position in the queue of the scheduler, or in the ready
+	// queue if ready is set, or -1 if the task is not queued.  due is the
+	// time the task is queued for.  seq is the order the task is added.
+	index int
+	ready bool
+	due   time.Time
+	seq   uint64
 }
 
 // TaskStatus defines the status of a task.
@@ -49,56 +98,403 @@ type TaskStatus struct {
 	NextUpdate time.Time
 	Completed  time.Time
 	Disabled   bool
+	// Started is the time the current or the last run started.
+	Started time.Time
+	// Priority decides the order of due tasks.  Tasks of higher priority
+	// run first, and tasks of the same priority run in the order they are
+	// due, then in the order they are added.
+	Priority int
+	// Attempt is the number of the current or the last run among the runs
+	// retrying a failure.  It is 1 for a run which is not a retry.
+	Attempt int
+	// Retrying tells that the last run failed, and the task is scheduled
+	// to retry it.
+	Retrying bool
+	// Paused tells that the task does not run on its schedule until it is
+	// resumed.
+	Paused bool
+}
+
+const statusRunning = "running"
+
+// taskResult is the outcome of a run.  A non-zero timeout means the run timed
+// out.  skipped means the run is skipped because its lock could not be
+// acquired, and err is the error of the LockProvider if any.
+type taskResult struct {
+	task    *Task
+	run     uint64
+	result  string
+	next    time.Time
+	err     error
+	timeout time.Duration
+	skipped bool
+	// abandoned tells that the run is abandoned by Shutdown.
+	abandoned bool
 }
 
 // TaskFunction defines the function of a task.
 type TaskFunction func(task *Task) (result string, nextUpdate time.Time, err error)
 
-// SetStatus sets the status of the running task.
-func (task *Task) SetStatus(status string) {
-	task.Status = status
-	task.bj4.logger.OnTaskStatusUpdate(task)
+// ContextTaskFunction defines the function of a task which receives a
+// context.  The context is cancelled when the scheduler stops, when the task is
+// removed, or when the timeout of the task passes.
+type ContextTaskFunction func(ctx context.Context, task *Task) (result string, nextUpdate time.Time, err error)
+
+// WrapTaskFunction adapts a TaskFunction into a ContextTaskFunction which
+// ignores the context.
+func WrapTaskFunction(fn TaskFunction) ContextTaskFunction {
+	return func(ctx context.Context, task *Task) (string, time.Time, error) {
+		return fn(task)
+	}
 }
 
-func (task *Task) run() {
-	if task.Disabled {
-		ttl := task.bj4.taskTTL
-		now := time.Now()
-		if ttl > 0 && now.Sub(task.Completed) >= ttl {
-			task.bj4.removeTask(task.Name)
-		}
-		return
+// TaskMiddleware wraps the function of a task.  The wrapped function runs in
+// place of the task function on every run, and can pass a derived context to
+// the task function.
+type TaskMiddleware func(next ContextTaskFunction) ContextTaskFunction
+
+// TaskOption sets an optional property of a task.
+type TaskOption func(task *Task)
+
+// WithSchedule sets the schedule of the task.  After every run the next update
+// time is computed from the schedule, unless the task function returns a
+// non-zero nextUpdate.  See ParseSchedule for creating a schedule from a cron
+// spec.
+func WithSchedule(schedule Schedule) TaskOption {
+	return func(task *Task) {
+		task.schedule = schedule
 	}
+}
 
-	if time.Since(task.NextUpdate) < 0 {
-		return
+// WithPriority sets the priority of the task.  See TaskStatus.Priority.
+func WithPriority(priority int) TaskOption {
+	return func(task *Task) {
+		task.Priority = priority
 	}
+}
 
+// PanicError is the error reported when a task function panics.
+type PanicError struct {
+	// Value is the value recovered from the panic.
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("bj4 task panicked: %v", e.Value)
+}
+
+// WithTimeout sets the timeout of every run of the task, overriding TaskTimeout.
+func WithTimeout(d time.Duration) TaskOption {
+	return func(task *Task) {
+		task.timeout = d
+	}
+}
+
+// FencingToken returns the fencing token of the leadership under which the
+// current run started.  Pass it to the resources the task writes to, so that
+// they can reject writes from a replica which has lost the leadership.  It is
+// zero if the scheduler has no LeaderElector.
+func (task *Task) FencingToken() uint64 {
+	task.mu.Lock()
+	defer task.mu.Unlock()
+	return task.token
+}
+
+// Triggered tells that the current run is started by TriggerTask instead of
+// the schedule of the task.
+func (task *Task) Triggered() bool {
+	task.mu.Lock()
+	defer task.mu.Unlock()
+	return task.triggered
+}
+
+// SetStatus sets the status of the running task.  It is safe to call from the
+// task function.  The status set once the run is done, such as by a timed out
+// function, is ignored.
+func (task *Task) SetStatus(status string) {
+	task.mu.Lock()
+	live := task.live
+	if live {
+		task.Status = status
+	}
+	task.mu.Unlock()
+	if live {
+		task.bj4.logger.OnTaskStatusUpdate(task)
+	}
+}
+
+// Snapshot returns a copy of the status of the task.  Unlike reading TaskStatus
+// directly, it is safe from a task function which outlives its timeout, when
+// the scheduler moves on to update the task.
+func (task *Task) Snapshot() TaskStatus {
+	task.mu.Lock()
+	defer task.mu.Unlock()
+	return task.TaskStatus
+}
+
+// run starts a task which is due.
+func (task *Task) run() {
 	// drain errorChan to prevent blocking
 	for len(task.errorChan) > 0 {
 		<-task.errorChan
 	}
 
-	task.Status = "running"
+	// a triggered run is keyed by the time it is triggered, so that its lock
+	// does not mark the scheduled run as done
+	due := task.NextUpdate
+	triggered := !task.trigger.IsZero()
+	if triggered {
+		due = task.trigger
+	}
+	task.trigger = time.Time{}
+
+	// a timed out run may still be reading the task
+	task.mu.Lock()
+	task.triggered = triggered
+	if task.Retrying {
+		task.Attempt++
+	} else {
+		task.Attempt = 1
+	}
+	task.Status = statusRunning
+	task.Started = task.bj4.clock.Now()
+	task.token = task.bj4.token
+	task.mu.Unlock()
+
+	task.takeWaiters()
+	if !triggered {
+		task.reportMisfire(task.bj4.clock.Now())
+	}
 	task.bj4.logger.OnTaskStart(task)
+	task.bj4.saveTask(task)
+
+	ctx, timeout := task.context()
+	task.runs++
+	task.mu.Lock()
+	task.live = true
+	task.mu.Unlock()
+	go task.execute(ctx, timeout, due, task.runs)
+}
+
+// execute runs the task function on its own goroutine, and reports the result
+// to the scheduler.  A timed out function is left behind.  If the scheduler
+// has a LockProvider, the lock of the run due at due is held until the
+// function returns, even if it times out, and the run is skipped if the lock
+// cannot be acquired.
+func (task *Task) execute(ctx context.Context, timeout time.Duration, due time.Time, run uint64) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ok, unlock, err := task.lock(ctx, due, cancel)
+	if !ok {
+		task.bj4.taskDone <- taskResult{task: task, run: run, err: err, skipped: true}
+		return
+	}
+
+	resultChan := make(chan taskResult, 1)
+	go func() {
+		res := taskResult{task: task, run: run}
+		defer func() {
+			if r := recover(); r != nil {
+				res.err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+			resultChan <- res
+		}()
+		res.result, res.next, res.err = task.function(ctx, task)
+	}()
+
+	var res taskResult
+	select {
+	case res = <-resultChan:
+		unlock()
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			res = taskResult{task: task, run: run, timeout: timeout}
+			go func() {
+				<-resultChan
+				unlock()
+			}()
+		} else {
+			// cancelled by Stop or RemoveTask, which still wait for the
+			// function to return
+			res = <-resultChan
+			unlock()
+		}
+	}
+	task.bj4.taskDone <- res
+}
+
+// finish updates the task with the result of a run, and returns the error the
+// run failed with.  The Logger and the waiters are notified once the lock of
+// the task is released, so that they may call Snapshot.
+func (task *Task) finish(res taskResult) error {
+	// a timed out function may still be running
+	task.mu.Lock()
+	notify, err := task.update(res)
+	task.mu.Unlock()
+	notify()
+	return err
+}
+
+// update updates the task with the result of a run, and returns the function
+// notifying the outcome.
+func (task *Task) update(res taskResult) (notify func(), err error) {
+	task.live = false
 
-	result, next, err := task.function(task)
+	if res.skipped {
+		return task.skip(res.err), nil
+	}
+	if res.abandoned {
+		return task.abandon(), ErrTaskAbandoned
+	}
+
+	_, panicked := res.err.(*PanicError)
+	disable := panicked && task.bj4.panicPolicy == PanicRecoverAndDisable
+
+	task.Completed = task.bj4.clock.Now()
+
+	err = res.err
+	if res.timeout > 0 {
+		err = ErrTaskTimeout
+	}
+	if err != nil && !disable && task.retry.shouldRetry(task.Attempt, err) {
+		delay := task.retry.delay(task.Attempt)
+		task.Retrying = true
+		task.NextUpdate = task.Completed.Add(delay)
+		task.Status = fmt.Sprintf("retrying: %s", err.Error())
+		return func() {
+			task.bj4.logger.OnTaskRetry(task, err, delay)
+		}, err
+	}
+	task.Retrying = false
 
-	task.Completed = time.Now()
-	if next.IsZero() {
+	next := res.next
+	if d := next.Sub(task.Completed); !next.IsZero() && d > 0 {
+		task.interval = d
+	}
+	if next.IsZero() && task.schedule != nil {
+		if task.misfire == MisfireCatchUp {
+			next = task.schedule.Next(task.NextUpdate)
+		} else {
+			next = task.schedule.Next(task.Completed)
+		}
+	} else if next.IsZero() && (panicked || res.timeout > 0) {
+		// the run has not told the next update time
+		interval := task.interval
+		if interval <= 0 {
+			interval = task.bj4.minWaitTime
+		}
+		next = task.Completed.Add(interval)
+	}
+	switch {
+	case !task.reschedule.IsZero():
+		task.rescheduleTo(task.reschedule)
+	case task.triggered && !disable:
+		// a triggered run keeps the schedule
+	case next.IsZero() || disable:
 		task.Disabled = true
 		task.NextUpdate = time.Time{}
-	} else {
+	default:
 		task.NextUpdate = next
 	}
 
+	switch {
+	case res.timeout > 0:
+		task.Status = fmt.Sprintf("timeout: exceeded %s", res.timeout)
+		return func() {
+			task.bj4.logger.OnTaskTimeout(task)
+			task.notifyWaiters(ErrTaskTimeout)
+			task.errorChan <- ErrTaskTimeout
+		}, err
+	case res.err != nil:
+		task.Status = fmt.Sprintf("error: %s", res.err.Error())
+		return func() {
+			task.bj4.logger.OnTaskError(task, res.err)
+			task.notifyWaiters(res.err)
+			task.errorChan <- res.err
+		}, err
+	default:
+		task.Status = fmt.Sprintf("completed: %s", res.result)
+		return func() {
+			task.bj4.logger.OnTaskComplete(task, res.result)
+			task.notifyWaiters(nil)
+			task.errorChan <- nil
+		}, err
+	}
+}
+
+// skip updates the task whose run is skipped because its lock could not be
+// acquired.  The task is scheduled on its next activation, or after the lock
+// TTL if it does not have a schedule.  Nothing is sent to the error channel,
+// since the run is done elsewhere.  Returns the function notifying the skip.
+func (task *Task) skip(err error) func() {
+	now := task.bj4.clock.Now()
+	if task.Retrying {
+		task.Attempt--
+	}
+	if task.schedule != nil {
+		task.NextUpdate = task.schedule.Next(now)
+	} else {
+		task.NextUpdate = now.Add(task.bj4.lockTTL)
+	}
+	if task.NextUpdate.IsZero() {
+		task.Disabled = true
+	}
+
 	if err != nil {
-		task.Status = fmt.Sprintf("error: %s", err.Error())
-		task.bj4.logger.OnTaskError(task, err)
-		task.errorChan <- err
+		task.Status = fmt.Sprintf("skipped: %s", err.Error())
+	} else {
+		task.Status = "skipped: " + statusLockHeld
+	}
+	return func() {
+		task.bj4.logger.OnTaskSkipped(task, err)
+		task.notifyWaiters(ErrLockHeld)
+	}
+}
+
+// abandon updates the task whose run is abandoned by Shutdown.  Like an
+// interrupted run, the next update time is not moved, so that the task runs
+// again as soon as the scheduler restarts.  Returns the function notifying the
+// abandonment.
+func (task *Task) abandon() func() {
+	task.Completed = task.bj4.clock.Now()
+	task.Status = statusAbandoned
+	return func() {
+		task.bj4.logger.OnTaskError(task, ErrTaskAbandoned)
+		task.notifyWaiters(ErrTaskAbandoned)
+		task.errorChan <- ErrTaskAbandoned
+	}
+}
+
+// addHistory keeps the record of a run, dropping the oldest records beyond
+// limit.
+func (task *Task) addHistory(record RunRecord, limit int) {
+	task.history = append(task.history, record)
+	if n := len(task.history) - limit; n > 0 {
+		task.history = append(task.history[:0], task.history[n:]...)
+	}
+}
+
+// context derives the context of a run from the scheduler, and registers its
+// cancel function so that RemoveTask can cancel it.  The timeout of the run is
+// returned as well.
+func (task *Task) context() (ctx context.Context, timeout time.Duration) {
+	bj4 := task.bj4
+	bj4.mu.Lock()
+	defer bj4.mu.Unlock()
+
+	timeout = task.timeout
+	if timeout == 0 {
+		timeout = bj4.taskTimeout
+	}
+
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = withTimeout(bj4.ctx, bj4.clock, timeout)
 	} else {
-		task.Status = fmt.Sprintf("completed: %s", result)
-		task.bj4.logger.OnTaskComplete(task, result)
-		task.errorChan <- nil
+		ctx, cancel = context.WithCancel(bj4.ctx)
 	}
+	bj4.running[task.Name] = cancel
+	return
 }